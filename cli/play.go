@@ -23,7 +23,7 @@ func main() {
 		log.Fatal("No file specified with -f")
 	}
 
-	hookEngine := engine.NewHookEngine("")
+	hookEngine := engine.NewHookEngine("", nil)
 
 	secrets := make(map[string]string)
 	var err error
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditType is the kind of an audit log entry.
+type AuditType string
+
+const (
+	AuditAPICall      AuditType = "api_call"
+	AuditRunTriggered AuditType = "run_triggered"
+	AuditRunFinished  AuditType = "run_finished"
+)
+
+// AuditEntry records who did what and when. Tokens are recorded by name,
+// never by value.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Type     AuditType `json:"type"`
+	Token    string    `json:"token,omitempty"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	// Method, Endpoint and StatusCode describe API calls. Endpoint is the
+	// route, e.g. /hooks/:id/:action.
+	Method     string            `json:"method,omitempty"`
+	Endpoint   string            `json:"endpoint,omitempty"`
+	StatusCode int               `json:"status_code,omitempty"`
+	Hook       string            `json:"hook,omitempty"`
+	Action     string            `json:"action,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	RunID      string            `json:"run_id,omitempty"`
+	// Outcome is the run status of run entries.
+	Outcome RunStatus `json:"outcome,omitempty"`
+}
+
+// AuditFilter selects audit log entries. Zero fields select everything.
+type AuditFilter struct {
+	Since  time.Time
+	Until  time.Time
+	Hook   string
+	Action string
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Time.After(f.Until):
+		return false
+	case f.Hook != "" && e.Hook != f.Hook:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	}
+	return true
+}
+
+// AuditLog appends entries as JSON lines to a file. The file is rotated when
+// it would grow over MaxSize bytes: it is renamed with a .1 suffix, older
+// files are shifted to .2, .3, ... and only MaxBackups of them are kept.
+type AuditLog struct {
+	Filename   string
+	MaxSize    int64
+	MaxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// NewAuditLog opens the audit log file, creating it if needed.
+func NewAuditLog(filename string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) backup(n int) string {
+	return fmt.Sprintf("%s.%d", a.Filename, n)
+}
+
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(a.backup(a.MaxBackups))
+	for n := a.MaxBackups - 1; n >= 1; n-- {
+		if err := os.Rename(a.backup(n), a.backup(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.MaxBackups > 0 {
+		if err := os.Rename(a.Filename, a.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.Filename); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Record appends an entry to the log, setting its time if missing.
+func (a *AuditLog) Record(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// Query returns the entries matching f, oldest first, including the ones of
+// rotated files.
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := []AuditEntry{}
+	filenames := []string{}
+	for n := a.MaxBackups; n >= 1; n-- {
+		filenames = append(filenames, a.backup(n))
+	}
+	filenames = append(filenames, a.Filename)
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		for scanner.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("Unable to read audit file %s: %s", filename, err.Error())
+			}
+			if f.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// audit records an entry in the engine audit log, if any.
+func (e *HookEngine) audit(entry AuditEntry) {
+	if e.Audit == nil {
+		return
+	}
+	if err := e.Audit.Record(entry); err != nil {
+		log.Errorf("Unable to write audit log: %s", err)
+	}
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotate(t *testing.T) {
+	dir := tempDir(t)
+	a, err := NewAuditLog(dir+"/audit.jsonl", 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		err := a.Record(AuditEntry{
+			Time:   start.Add(time.Duration(i) * time.Hour),
+			Type:   AuditAPICall,
+			Hook:   []string{"mywebsite", "database"}[i%2],
+			Action: "deploy",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(dir + "/audit.jsonl.3"); !os.IsNotExist(err) {
+		t.Fatalf("want no more than 2 backups, got %+v", err)
+	}
+	info, err := os.Stat(dir + "/audit.jsonl.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 300 {
+		t.Fatalf("want rotated file of at most 300 bytes, got %+v", info.Size())
+	}
+
+	entries, err := a.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || len(entries) >= 10 {
+		t.Fatalf("want oldest entries dropped, got %+v entries", len(entries))
+	}
+	last := entries[len(entries)-1].Time
+	if !last.Equal(start.Add(9 * time.Hour)) {
+		t.Fatalf("want %+v, got %+v", start.Add(9*time.Hour), last)
+	}
+
+	entries, err = a.Query(AuditFilter{Since: start.Add(7 * time.Hour), Hook: "database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := len(entries)
+	expected := 2
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookAudit(t *testing.T) {
+	setup()
+	e.Secrets["foo"] = "s3cr3t"
+	a, err := NewAuditLog(tempDir(t)+"/audit.jsonl", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Audit = a
+	h, err := e.ReadHook("tests/hooks", "tests", "test_trigger_vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.RunTrigger(Trigger{
+		Vars:     map[string]string{"image_tag": "v1 s3cr3t"},
+		Token:    "ci",
+		SourceIP: "10.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Wait(context.Background())
+	entries, err := a.Query(AuditFilter{Hook: "tests", Action: "test_trigger_vars"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("want 2 entries, got %+v", entries)
+	}
+	for i := range entries {
+		entries[i].Time = time.Time{}
+	}
+	expected := []AuditEntry{
+		{Type: AuditRunTriggered, Token: "ci", SourceIP: "10.0.0.1", Hook: "tests", Action: "test_trigger_vars", Params: map[string]string{"image_tag": "v1 ***"}, RunID: r.ID, Outcome: RunQueued},
+		{Type: AuditRunFinished, Token: "ci", SourceIP: "10.0.0.1", Hook: "tests", Action: "test_trigger_vars", RunID: r.ID, Outcome: r.State().Status},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("want %+v, got %+v", expected, entries)
+	}
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Concurrency is the policy applied to a trigger while other runs of the same
+// hook action are in progress.
+type Concurrency string
+
+const (
+	// ConcurrencyParallel starts every run right away.
+	ConcurrencyParallel Concurrency = "parallel"
+	// ConcurrencyQueue starts a run once the previous ones are over.
+	ConcurrencyQueue Concurrency = "queue"
+	// ConcurrencySkip rejects a trigger while a run is in progress.
+	ConcurrencySkip Concurrency = "skip"
+	// ConcurrencyCancelPrevious cancels the runs in progress and starts the
+	// new run once they are over.
+	ConcurrencyCancelPrevious Concurrency = "cancel_previous"
+)
+
+// ErrRunInProgress is returned when triggering a hook with the skip
+// concurrency policy while one of its runs is in progress.
+var ErrRunInProgress = errors.New("a run of this hook is already in progress")
+
+// validateConcurrency checks the concurrency settings of the hook.
+func (h *Hook) validateConcurrency() error {
+	switch h.Concurrency {
+	case "", ConcurrencyParallel:
+		if h.ConcurrencyKey != "" {
+			return fmt.Errorf("concurrency_key is not allowed with parallel concurrency")
+		}
+	case ConcurrencyQueue, ConcurrencySkip, ConcurrencyCancelPrevious:
+		if h.ConcurrencyKey != "" && !varNameRegexp.MatchString(h.ConcurrencyKey) {
+			return fmt.Errorf("Invalid concurrency_key %s", h.ConcurrencyKey)
+		}
+	default:
+		return fmt.Errorf("Invalid concurrency %s", h.Concurrency)
+	}
+	return nil
+}
+
+// concurrencyGroup returns the group of the runs sharing the concurrency
+// policy of the hook: every run of the action, or the runs with the same
+// value of the concurrency key. It is empty for parallel runs.
+func (h *Hook) concurrencyGroup(vars map[string]string) string {
+	if h.Concurrency == "" || h.Concurrency == ConcurrencyParallel {
+		return ""
+	}
+	group := h.Name + "/" + h.Action
+	if h.ConcurrencyKey != "" {
+		value, ok := vars[h.ConcurrencyKey]
+		if !ok {
+			value = h.GlobalVars[h.ConcurrencyKey]
+		}
+		group += "\xff" + value
+	}
+	return group
+}
+
+// concurrencyGroups holds the runs in progress of every concurrency group.
+// The first run of a group is started, the others wait for it.
+type concurrencyGroups struct {
+	mu   sync.Mutex
+	runs map[string][]*Run
+}
+
+// add appends the run to its group and reports whether it is the first one,
+// to be started. It must be called with the lock held.
+func (g *concurrencyGroups) add(run *Run) bool {
+	if g.runs == nil {
+		g.runs = make(map[string][]*Run)
+	}
+	g.runs[run.concurrencyGroup] = append(g.runs[run.concurrencyGroup], run)
+	return len(g.runs[run.concurrencyGroup]) == 1
+}
+
+// done takes the finished run out of its group and starts the next one.
+func (g *concurrencyGroups) done(run *Run) {
+	if run.concurrencyGroup == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	runs := g.runs[run.concurrencyGroup]
+	if len(runs) == 0 || runs[0] != run {
+		return
+	}
+	runs = runs[1:]
+	if len(runs) == 0 {
+		delete(g.runs, run.concurrencyGroup)
+		return
+	}
+	g.runs[run.concurrencyGroup] = runs
+	runs[0].Hook.start(runs[0])
+}
+
+// remove takes the run out of its group and reports whether it was waiting
+// for a previous run.
+func (g *concurrencyGroups) remove(run *Run) bool {
+	if run.concurrencyGroup == "" {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	runs := g.runs[run.concurrencyGroup]
+	for i := 1; i < len(runs); i++ {
+		if runs[i] == run {
+			g.runs[run.concurrencyGroup] = append(runs[:i:i], runs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func cancelRuns(t *testing.T, runs ...*Run) {
+	for _, r := range runs {
+		if err := r.Cancel(); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if !r.Wait(ctx) {
+			t.Fatalf("run %s not over after cancellation", r.ID)
+		}
+		cancel()
+	}
+}
+
+func TestConcurrencyQueue(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_concurrency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := h.Run(map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.Run(map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := h.Run(map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another key is not serialized with prod runs
+	staging, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, first, RunRunning)
+	waitStatus(t, staging, RunRunning)
+	time.Sleep(100 * time.Millisecond)
+	output := second.State().Status
+	expected := RunQueued
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+
+	// a cancelled waiting run leaves the group right away
+	cancelRuns(t, third)
+	output = second.State().Status
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+
+	cancelRuns(t, first)
+	waitStatus(t, second, RunRunning)
+	cancelRuns(t, second, staging)
+}
+
+func TestConcurrencySkip(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_concurrency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Concurrency = ConcurrencySkip
+	first, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Run(nil); err != ErrRunInProgress {
+		t.Fatalf("want %+v, got %+v", ErrRunInProgress, err)
+	}
+	cancelRuns(t, first)
+	second, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelRuns(t, second)
+}
+
+func TestConcurrencyCancelPrevious(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_concurrency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Concurrency = ConcurrencyCancelPrevious
+	first, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, first, RunRunning)
+	second, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, first, RunCancelled)
+	waitStatus(t, second, RunCancelled)
+	waitStatus(t, third, RunRunning)
+	cancelRuns(t, third)
+}
+
+func TestConcurrencyInvalid(t *testing.T) {
+	setup()
+	if _, err := e.ReadHook("tests/hooks", "invalid", "concurrency"); err == nil {
+		t.Fatal("want error for invalid concurrency")
+	}
+	h := &Hook{Concurrency: ConcurrencyParallel, ConcurrencyKey: "env"}
+	if err := h.validateConcurrency(); err == nil {
+		t.Fatal("want error for concurrency_key with parallel concurrency")
+	}
+}
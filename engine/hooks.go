@@ -1,12 +1,17 @@
 package engine
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -17,19 +22,116 @@ import (
 )
 
 var (
-	log  = logrus.New()
-	runs map[string]*Run
-	lock = sync.Mutex{}
+	log = logrus.New()
+
+	// DefaultTaskTimeout is the command deadline used when a task does not
+	// define its own timeout.
+	DefaultTaskTimeout = 60 * time.Second
+
+	// ErrHookNotFound is returned when reading an action which does not
+	// exist.
+	ErrHookNotFound = errors.New("hook not found")
+
+	// hookIDRegexp matches valid hook ids and action names.
+	hookIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+	// ErrTimeout is returned when a command is killed because its task or
+	// its hook reached the configured timeout.
+	ErrTimeout = errors.New("command timed out")
+
+	// ErrCancelled is returned when a command is killed because its run was
+	// cancelled.
+	ErrCancelled = errors.New("run cancelled")
+)
+
+// RunStatus is the lifecycle state of a run.
+type RunStatus string
+
+const (
+	RunQueued    RunStatus = "queued"
+	RunRunning   RunStatus = "running"
+	RunSucceeded RunStatus = "succeeded"
+	// RunSucceededWithFailures is the status of a run which went through
+	// all its tasks thanks to continue_after_failure.
+	RunSucceededWithFailures RunStatus = "succeeded_with_failures"
+	RunFailed                RunStatus = "failed"
+	RunCancelled             RunStatus = "cancelled"
+	RunTimedOut              RunStatus = "timed_out"
+	// RunInterrupted is the status of a run which was in progress when
+	// nombda stopped.
+	RunInterrupted RunStatus = "interrupted"
 )
 
+// Terminal reports whether a run in this status is over.
+func (s RunStatus) Terminal() bool {
+	switch s {
+	case RunQueued, RunRunning:
+		return false
+	}
+	return true
+}
+
+// RunState holds what is known about a run. It is only modified by the run
+// itself, under the run lock; other goroutines read it through Run.State.
+type RunState struct {
+	HookName   string            `json:"hook"`
+	Action     string            `json:"action"`
+	ID         string            `json:"id"`
+	Status     RunStatus         `json:"status"`
+	ExitCode   int               `json:"exit_code"`
+	StartedAt  *time.Time        `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at"`
+	FailedTask string            `json:"failed_task"`
+	Steps      []StepResult      `json:"steps"`
+	Registers  map[string]string `json:"registers"`
+	// Vars are the variables given by the caller when triggering the run.
+	Vars map[string]string `json:"vars"`
+	// Outputs are the values of the hook outputs, evaluated when the run
+	// finishes.
+	Outputs map[string]string `json:"outputs"`
+	// TraceID is the trace of the run spans when tracing is enabled.
+	TraceID string `json:"trace_id,omitempty"`
+}
+
 type Run struct {
-	Hook      *Hook
-	ID        string
-	ExitCode  int
-	Completed bool
-	Output    string
-	Registers map[string]string
-	Secrets   map[string]string
+	RunState
+	Hook      *Hook             `json:"-"`
+	Output    *LogBuffer        `json:"output"`
+	Secrets   map[string]string `json:"-"`
+	mu        sync.RWMutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	cancelled bool
+	// recovering is set once an on_failure handler runs after the run was
+	// cancelled.
+	recovering bool
+	// trigger is what the caller gave when triggering the run.
+	trigger  Trigger
+	handlers []string
+	tasks    []string
+	// spans are the open spans, innermost last, parentSpanID the span of
+	// the caller, if any.
+	spans         []*Span
+	finishedSpans []Span
+	parentSpanID  string
+	// concurrencyGroup is the group of the run if its hook does not run in
+	// parallel.
+	concurrencyGroup string
+}
+
+// StepResult is the outcome of a task or handler task executed by a run.
+type StepResult struct {
+	Name string `json:"name"`
+	// HandlerPath lists the handlers the task was called from, outermost
+	// first, e.g. "rollback > reload_nginx".
+	HandlerPath string        `json:"handler_path"`
+	Command     string        `json:"command"`
+	ExitCode    int           `json:"exit_code"`
+	StartedAt   time.Time     `json:"started_at"`
+	Duration    time.Duration `json:"duration"`
+	Skipped     bool          `json:"skipped"`
+	Attempts    int           `json:"attempts"`
 }
 
 // type Handler struct {
@@ -46,9 +148,11 @@ type Task struct {
 	Interval             int               `yaml:"interval"`
 	Timeout              int               `yaml:"timeout"`
 	OnFailure            string            `yaml:"on_failure"`
+	OnFailureOnCancel    bool              `yaml:"on_failure_on_cancel"`
 	ContinueAfterFailure bool              `yaml:"continue_after_failure"`
 	OnlyIf               string            `yaml:"only_if"`
 	Register             string            `yaml:"register"`
+	RegisterStream       string            `yaml:"register_stream"`
 	Vars                 map[string]string `yaml:"vars"`
 	Cd                   string            `yaml:"cd"`
 }
@@ -59,7 +163,19 @@ type Hook struct {
 	Handlers   map[string][]*Task `yaml:"handlers"`
 	Tasks      []*Task            `yaml:"tasks"`
 	GlobalVars map[string]string  `yaml:"vars"`
-	HookEngine *HookEngine
+	Timeout    int                `yaml:"timeout"`
+	Params     map[string]*Param  `yaml:"params"`
+	Outputs    map[string]string  `yaml:"outputs"`
+	Notify     []*Notify          `yaml:"notify"`
+	Webhook    *Webhook           `yaml:"webhook"`
+	// Concurrency is the policy of runs triggered while others are in
+	// progress, parallel if empty.
+	Concurrency Concurrency `yaml:"concurrency"`
+	// ConcurrencyKey names a var whose value splits the runs in groups,
+	// the policy only applies to runs of the same group.
+	ConcurrencyKey string      `yaml:"concurrency_key"`
+	Schedule       []*Schedule `yaml:"schedule"`
+	HookEngine     *HookEngine `json:"-"`
 }
 
 // type HookStep struct {
@@ -76,24 +192,63 @@ type HookStepRunResponse struct {
 type HookEngine struct {
 	ConfigDir string
 	Secrets   map[string]string
+	Store     RunStore
+	// CallbackSecret is the default HMAC key signing run callbacks.
+	CallbackSecret string
+	// Audit records run triggers and outcomes if not nil.
+	Audit   *AuditLog
+	Metrics *Metrics
+	// SpanExporter receives the spans of every run if not nil.
+	SpanExporter SpanExporter
+	// Queue bounds the number of concurrent runs. Runs all start at once
+	// if nil.
+	Queue       *RunQueue
+	concurrency concurrencyGroups
 }
 
-func NewHookEngine(configDir string) *HookEngine {
-	runs = make(map[string]*Run)
+// NewHookEngine returns an engine reading hooks from configDir and keeping
+// runs in store. A nil store keeps runs in memory.
+func NewHookEngine(configDir string, store RunStore) *HookEngine {
+	if store == nil {
+		store = NewMemoryRunStore()
+	}
 	return &HookEngine{
 		ConfigDir: configDir,
 		Secrets:   make(map[string]string),
+		Store:     store,
+		Metrics:   NewMetrics(),
 	}
 }
 
 func (e *HookEngine) Hooks() ([]*Hook, error) {
-	actionsFilename, err := filepath.Glob(e.ConfigDir + "/*/*.yml")
+	actions, err := e.actions()
 	if err != nil {
 		return nil, err
 	}
 
 	var hooks []*Hook
 
+	for _, action := range actions {
+		hook, err := e.ReadHook(e.ConfigDir, action[0], action[1])
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// actions lists the hook id and action of every action file of the config
+// directory.
+func (e *HookEngine) actions() ([][2]string, error) {
+	actionsFilename, err := filepath.Glob(e.ConfigDir + "/*/*.yml")
+	if err != nil {
+		return nil, err
+	}
+
+	var actions [][2]string
+
 	for _, actionFilename := range actionsFilename {
 		actionFilenameSplitted := strings.Split(actionFilename, "/")
 		if len(actionFilenameSplitted) < 2 {
@@ -103,14 +258,14 @@ func (e *HookEngine) Hooks() ([]*Hook, error) {
 		actionFileName := filepath.Base(actionFilename)
 		extension := filepath.Ext(actionFileName)
 		action := actionFileName[0 : len(actionFileName)-len(extension)]
-		hook, err := e.ReadHook(e.ConfigDir, id, action)
-		if err != nil {
-			return nil, err
+		if !hookIDRegexp.MatchString(id) || !hookIDRegexp.MatchString(action) {
+			log.Warnf("Ignoring action file with invalid name %s", actionFilename)
+			continue
 		}
-		hooks = append(hooks, hook)
+		actions = append(actions, [2]string{id, action})
 	}
 
-	return hooks, nil
+	return actions, nil
 }
 
 func (e *HookEngine) ReadHookFromFile(p string) (*Hook, error) {
@@ -124,11 +279,31 @@ func (e *HookEngine) ReadHookFromFile(p string) (*Hook, error) {
 	if err := yaml.UnmarshalStrict(data, &h); err != nil {
 		return nil, fmt.Errorf("Unable to validate yaml file: %s", err.Error())
 	}
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
 	return h, nil
 }
 
+// ReadHook reads the action of hook name from the config directory path, or
+// from the engine ConfigDir if path is empty. Names are checked against
+// hookIDRegexp and the action file must stay inside path, and inside the
+// engine ConfigDir if set, even through symlinks. ErrHookNotFound is returned
+// if there is no such action.
 func (e *HookEngine) ReadHook(path string, name string, action string) (*Hook, error) {
-	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/%s.yml", path, name, action))
+	if path == "" {
+		path = e.ConfigDir
+	}
+	filename, err := hookFilename(path, name, action)
+	if err != nil {
+		return nil, err
+	}
+	if e.ConfigDir != "" {
+		if err := checkInsideDir(e.ConfigDir, filename, name, action); err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -138,15 +313,98 @@ func (e *HookEngine) ReadHook(path string, name string, action string) (*Hook, e
 	if err := yaml.UnmarshalStrict(data, &h); err != nil {
 		return nil, fmt.Errorf("Unable to validate yaml file: %s", err.Error())
 	}
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
 	h.Name = name
 	h.Action = action
 	return h, nil
 }
 
-func localRun(command string, envs map[string]string, cd string) ([]byte, int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+// hookFilename returns the resolved path of the action file in dir.
+func hookFilename(dir string, name string, action string) (string, error) {
+	if !hookIDRegexp.MatchString(name) {
+		return "", fmt.Errorf("Invalid hook id %q", name)
+	}
+	if !hookIDRegexp.MatchString(action) {
+		return "", fmt.Errorf("Invalid action %q", action)
+	}
+	filename, err := filepath.EvalSymlinks(filepath.Join(dir, name, action+".yml"))
+	if os.IsNotExist(err) {
+		return "", ErrHookNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if filename, err = filepath.Abs(filename); err != nil {
+		return "", err
+	}
+	if err := checkInsideDir(dir, filename, name, action); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// checkInsideDir returns an error if the resolved action filename is not
+// inside dir.
+func checkInsideDir(dir string, filename string, name string, action string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Action file of %s/%s is outside of the config directory", name, action)
+	}
+	return nil
+}
+
+// validate checks the attributes yaml decoding cannot check.
+func (h *Hook) validate() error {
+	tasks := append([]*Task(nil), h.Tasks...)
+	for _, handlerTasks := range h.Handlers {
+		tasks = append(tasks, handlerTasks...)
+	}
+	for _, t := range tasks {
+		switch t.RegisterStream {
+		case "", "stdout", "stderr", "both":
+		default:
+			return fmt.Errorf("Invalid register_stream %s in task %s", t.RegisterStream, t.label())
+		}
+		if t.OnFailureOnCancel && (t.HandlerName == "" || t.OnFailure == "") {
+			return fmt.Errorf("on_failure_on_cancel needs handler and on_failure in task %s", t.label())
+		}
+	}
+	for name := range h.Outputs {
+		if !varNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid output name %s", name)
+		}
+	}
+	if err := h.validateNotify(); err != nil {
+		return err
+	}
+	if err := h.validateWebhook(); err != nil {
+		return err
+	}
+	if err := h.validateConcurrency(); err != nil {
+		return err
+	}
+	if err := h.validateParams(); err != nil {
+		return err
+	}
+	return h.validateSchedule()
+}
+
+// localRun runs command with /bin/sh. Its output is returned and also written
+// to stdout and stderr as it is produced.
+func localRun(ctx context.Context, command string, envs map[string]string, cd string, timeout time.Duration, stdout io.Writer, stderr io.Writer) (*HookStepRunResponse, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	setProcessGroup(cmd)
 	cmd.Env = os.Environ()
 	if cd != "" {
 		cmd.Dir = cd
@@ -155,18 +413,34 @@ func localRun(command string, envs map[string]string, cd string) ([]byte, int, e
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 	}
 
-	// stderr, err := cmd.StderrPipe()
-	// if err != nil {
-	// 	return nil, nil, cmd.ProcessState.ExitCode(), err
-	// }
-	// stdout, err := cmd.StdoutPipe()
-	// if err != nil {
-	// 	return nil, nil, cmd.ProcessState.ExitCode(), err
-	// }
-	// if err := cmd.Start(); err != nil {
-	// 	return nil, nil, cmd.ProcessState.ExitCode(), err
-	// }
-	output, err := cmd.CombinedOutput()
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(&outBuf, stdout)
+	cmd.Stderr = io.MultiWriter(&errBuf, stderr)
+	if err := cmd.Start(); err != nil {
+		return nil, -1, err
+	}
+	// exec.CommandContext only kills /bin/sh, leaving its children running
+	// and holding the output pipe open: kill the whole process group instead.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	output := &HookStepRunResponse{
+		Stdout: outBuf.Bytes(),
+		Stderr: errBuf.Bytes(),
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return output, cmd.ProcessState.ExitCode(), ErrTimeout
+	case context.Canceled:
+		return output, cmd.ProcessState.ExitCode(), ErrCancelled
+	}
 	if err != nil {
 		return output, cmd.ProcessState.ExitCode(), err
 	}
@@ -187,35 +461,160 @@ func NewRun(h *Hook) (*Run, error) {
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	run := &Run{
-		Hook:      h,
-		ID:        id.String(),
-		Registers: make(map[string]string),
-		Secrets:   h.HookEngine.Secrets,
+		RunState: RunState{
+			HookName:  h.Name,
+			Action:    h.Action,
+			ID:        id.String(),
+			Status:    RunQueued,
+			Registers: make(map[string]string),
+		},
+		Hook:    h,
+		Output:  &LogBuffer{},
+		Secrets: h.HookEngine.Secrets,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
 	}
+	if err := h.HookEngine.Store.Save(run); err != nil {
+		return nil, err
+	}
+	if run.tracing() {
+		run.TraceID = randomID(16)
+	}
+	h.HookEngine.Metrics.runQueued(h.Name, h.Action)
 	return run, nil
 }
 
+// update applies fn to the run state under the run lock.
+func (r *Run) update(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn()
+}
+
+// State returns a copy of the run state which is safe to read while the run
+// goes on. Secrets registered by commands or given by the caller are masked
+// in its registers and vars.
+func (r *Run) State() RunState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	state := r.RunState
+	state.Steps = append([]StepResult(nil), r.Steps...)
+	state.Registers = make(map[string]string, len(r.Registers))
+	for k, v := range r.Registers {
+		state.Registers[k], _ = r.maskSecrets(v)
+	}
+	state.Vars = make(map[string]string, len(r.Vars))
+	for k, v := range r.Vars {
+		state.Vars[k], _ = r.maskSecrets(v)
+	}
+	if r.Outputs != nil {
+		state.Outputs = make(map[string]string, len(r.Outputs))
+		for k, v := range r.Outputs {
+			state.Outputs[k] = v
+		}
+	}
+	return state
+}
+
+func (r *Run) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RunState
+		Output *LogBuffer `json:"output"`
+	}{r.State(), r.Output})
+}
+
+func (r *Run) isCancelled() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cancelled
+}
+
+// save persists the run, logging failures since they must not stop it.
+func (r *Run) save() {
+	if err := r.Hook.HookEngine.Store.Save(r); err != nil {
+		log.Errorf("Unable to save run %s: %s", r.ID, err)
+	}
+}
+
 func (r *Run) hideSecrets(input string) string {
+	masked, replaced := r.maskSecrets(input)
+	r.metrics().secretsReplaced(replaced)
+	return masked
+}
+
+// maskSecrets returns input with secret values masked and the number of
+// values masked, without counting them in the metrics.
+func (r *Run) maskSecrets(input string) (string, int) {
 	replacers := make([]string, len(r.Secrets)*2)
 	for _, v := range r.Secrets {
 		replacers = append(replacers, v)
 		replacers = append(replacers, "***")
 	}
 	re := strings.NewReplacer(replacers...)
-	return re.Replace(input)
+	masked := re.Replace(input)
+	replaced := 0
+	if masked != input {
+		for _, v := range r.Secrets {
+			if v != "" {
+				replaced += strings.Count(input, v)
+			}
+		}
+	}
+	return masked, replaced
+}
+
+// metrics returns the metrics of the engine of the run, nil for runs read
+// from a store.
+func (r *Run) metrics() *Metrics {
+	if r.Hook == nil {
+		return nil
+	}
+	return r.Hook.HookEngine.Metrics
 }
 
-func (r *Run) logOutput(input string) {
-	r.Output += r.hideSecrets(input)
+// hideSecretsMap returns a copy of vars with secret values masked.
+func (r *Run) hideSecretsMap(vars map[string]string) map[string]string {
+	masked := make(map[string]string, len(vars))
+	for k, v := range vars {
+		masked[k] = r.hideSecrets(v)
+	}
+	return masked
+}
+
+// emit appends an event to the run log, filling in the run, the current
+// task and its handler path.
+func (r *Run) emit(e Event) {
+	e.Time = time.Now()
+	e.RunID = r.ID
+	e.Hook = r.HookName
+	e.Action = r.Action
+	r.mu.RLock()
+	if len(r.tasks) > 0 {
+		e.Task = r.tasks[len(r.tasks)-1]
+	}
+	e.HandlerPath = strings.Join(r.handlers, " > ")
+	r.mu.RUnlock()
+	e.Message = r.hideSecrets(e.Message)
+	r.Output.Append(e)
+}
+
+// liveOutput returns a writer sending a command stream to the run log line by
+// line, so secrets are hidden in whole lines.
+func (r *Run) liveOutput(stream string) *lineWriter {
+	return &lineWriter{log: func(line string) {
+		r.emit(Event{Type: EventCommandOutput, Stream: stream, Message: line})
+	}}
 }
 
 func (r *Run) logInfo(input ...string) {
-	r.logOutput(fmt.Sprintf("[INFO] %s\n", strings.Join(input, " ")))
+	r.emit(Event{Type: EventMessage, Level: "INFO", Message: strings.Join(input, " ")})
 }
 
 func (r *Run) logError(input ...string) {
-	r.logOutput(fmt.Sprintf("[ERROR] %s\n", strings.Join(input, " ")))
+	r.emit(Event{Type: EventMessage, Level: "ERROR", Message: strings.Join(input, " ")})
 }
 
 func (r *Run) Interpolate(input string, vars map[string]string) string {
@@ -226,6 +625,12 @@ func (r *Run) Interpolate(input string, vars map[string]string) string {
 			replacers = append(replacers, fmt.Sprintf("${%s}", k))
 		}
 	}
+	// vars given by the caller are never pasted into commands, they are
+	// only read from the environment
+	for k := range r.Vars {
+		replacers = append(replacers, fmt.Sprintf("${var.%s}", k))
+		replacers = append(replacers, fmt.Sprintf("${%s}", k))
+	}
 	if len(r.Secrets) > 0 {
 		for k, _ := range r.Secrets {
 			replacers = append(replacers, fmt.Sprintf("${secret.%s}", k))
@@ -241,35 +646,49 @@ func (r *Run) Interpolate(input string, vars map[string]string) string {
 	return re.Replace(input)
 }
 
-func (r *Run) RunHandler(src *Task, handlerName string) error {
-	r.logInfo("Running handler", handlerName)
+func (r *Run) RunHandler(src *Task, handlerName string) (err error) {
+	r.startSpan("handler "+handlerName, map[string]interface{}{"nombda.handler": handlerName})
+	defer func() { r.endSpan(err) }()
+	r.emit(Event{
+		Type:    EventHandlerEntered,
+		Handler: handlerName,
+		Level:   "INFO",
+		Message: "Running handler " + handlerName,
+	})
+	r.update(func() { r.handlers = append(r.handlers, handlerName) })
+	defer r.update(func() { r.handlers = r.handlers[:len(r.handlers)-1] })
 	handlerTasks := r.Hook.Handlers[handlerName]
 	if handlerTasks == nil {
 		r.logError("Unknown handler", handlerName)
 		return fmt.Errorf("Unknown handler %s", handlerName)
 	}
-	for _, handlerTask := range handlerTasks {
-		if handlerTask.Vars == nil {
-			handlerTask.Vars = make(map[string]string)
+	for _, t := range handlerTasks {
+		// hooks are shared between runs: work on a copy of the task to pass
+		// the caller vars
+		handlerTask := *t
+		handlerTask.Vars = make(map[string]string)
+		for k, v := range t.Vars {
+			handlerTask.Vars[k] = v
 		}
 		for k, v := range src.Vars {
 			handlerTask.Vars[k] = r.Interpolate(v, r.Registers)
 		}
-		err := r.RunTask(handlerTask)
+		err := r.RunTask(&handlerTask)
 		if err != nil {
 			r.logError("Failure in handler", handlerName)
-			if handlerTask.OnFailure != "" {
+			if handlerTask.OnFailure != "" && r.recoverable(&handlerTask) {
 				r.logInfo("Recovering error in handler", handlerName, "with handler", handlerTask.OnFailure)
-				err := r.RunHandler(handlerTask, handlerTask.OnFailure)
+				err := r.RunHandler(&handlerTask, handlerTask.OnFailure)
 				if err != nil {
 					if !handlerTask.ContinueAfterFailure {
 						return err
 					}
+					r.continueAfterFailure(&handlerTask)
 					return nil
 
 				}
 			}
-			return fmt.Errorf("Failure in handler %s", handlerName)
+			return fmt.Errorf("Failure in handler %s: %w", handlerName, err)
 		}
 	}
 	return nil
@@ -283,6 +702,9 @@ func (r *Run) MakeEnv(more map[string]string) map[string]string {
 	for k, v := range r.Hook.GlobalVars {
 		env[k] = v
 	}
+	for k, v := range r.Vars {
+		env[k] = v
+	}
 	for k, v := range r.Registers {
 		env[k] = v
 	}
@@ -292,23 +714,200 @@ func (r *Run) MakeEnv(more map[string]string) map[string]string {
 	return env
 }
 
+// retry calls fn until it succeeds or the task has been attempted
+// t.Retry + 1 times, sleeping t.Interval seconds between attempts. It returns
+// the number of attempts made.
+func (r *Run) retry(t *Task, fn func(attempt int) error) (int, error) {
+	attempts := t.Retry + 1
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempts > 1 {
+			r.logInfo(fmt.Sprintf("Attempt %d/%d for step", attempt, attempts), t.Name)
+		}
+		err = fn(attempt)
+		if err == nil || r.ctx.Err() != nil {
+			return attempt, err
+		}
+		if attempt < attempts {
+			r.logError(fmt.Sprintf("Attempt %d/%d failed for step", attempt, attempts), t.Name)
+			if t.Interval > 0 {
+				// a cancel or the hook timeout stops the wait
+				select {
+				case <-time.After(time.Duration(t.Interval) * time.Second):
+				case <-r.ctx.Done():
+					if r.ctx.Err() == context.DeadlineExceeded {
+						r.logTimeout(t)
+						return attempt, ErrTimeout
+					}
+					return attempt, err
+				}
+			}
+		}
+	}
+	return attempts, err
+}
+
+// registered returns the command output selected by register_stream.
+func (t *Task) registered(output *HookStepRunResponse) string {
+	switch t.RegisterStream {
+	case "stderr":
+		return string(output.Stderr)
+	case "both":
+		return string(output.Stdout) + string(output.Stderr)
+	}
+	return string(output.Stdout)
+}
+
+// timeout returns the command deadline configured for the task.
+func (t *Task) timeout() time.Duration {
+	if t.Timeout <= 0 {
+		return DefaultTaskTimeout
+	}
+	return time.Duration(t.Timeout) * time.Second
+}
+
+// logTimeout reports a command killed by either the task or the hook timeout.
+func (r *Run) logTimeout(t *Task) {
+	if r.ctx.Err() == context.DeadlineExceeded {
+		r.logError(fmt.Sprintf("Hook timeout of %ds reached in step", r.Hook.Timeout), t.Name)
+		return
+	}
+	r.logError(fmt.Sprintf("Timeout of %s reached in step", t.timeout()), t.Name)
+}
+
+// recoverable reports whether the on_failure handler of t may run. Once the
+// run is cancelled, only tasks with on_failure_on_cancel are recovered, and
+// their handler runs in a new context, with the deadline of the hook timeout,
+// which a second cancellation stops for good.
+func (r *Run) recoverable(t *Task) bool {
+	if !r.isCancelled() {
+		return true
+	}
+	if t.OnFailure == "" || !t.OnFailureOnCancel {
+		return false
+	}
+	if r.ctx.Err() != nil {
+		if r.recovering {
+			return false
+		}
+		r.logInfo("Running handler", t.OnFailure, "after cancellation")
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if deadline, ok := r.ctx.Deadline(); ok {
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		r.update(func() {
+			r.ctx = ctx
+			r.cancel = cancel
+			r.recovering = true
+		})
+	}
+	return true
+}
+
+// startStep records the beginning of t in the run steps and returns its
+// index.
+func (r *Run) startStep(t *Task) int {
+	r.update(func() {
+		r.Steps = append(r.Steps, StepResult{
+			Name:        t.label(),
+			HandlerPath: strings.Join(r.handlers, " > "),
+			StartedAt:   time.Now(),
+		})
+		r.tasks = append(r.tasks, t.label())
+	})
+	r.startSpan("task "+t.label(), map[string]interface{}{
+		"nombda.task":         t.label(),
+		"nombda.handler_path": strings.Join(r.handlers, " > "),
+	})
+	r.emit(Event{Type: EventStepStarted})
+	return len(r.Steps) - 1
+}
+
+func (r *Run) finishStep(step int, err error) {
+	var exitCode int
+	var result StepResult
+	r.update(func() {
+		s := &r.Steps[step]
+		s.Duration = time.Since(s.StartedAt)
+		if !s.Skipped {
+			s.ExitCode = r.ExitCode
+		}
+		exitCode = s.ExitCode
+		result = *s
+	})
+	r.emit(Event{Type: EventStepFinished, ExitCode: &exitCode})
+	if result.Command != "" && !result.Skipped {
+		r.metrics().stepFinished(r.HookName, r.Action, result.Duration, &exitCode)
+	} else {
+		r.metrics().stepFinished(r.HookName, r.Action, result.Duration, nil)
+	}
+	r.setSpanAttribute("nombda.exit_code", exitCode)
+	r.setSpanAttribute("nombda.attempts", result.Attempts)
+	r.setSpanAttribute("nombda.skipped", result.Skipped)
+	r.endSpan(err)
+	r.update(func() { r.tasks = r.tasks[:len(r.tasks)-1] })
+	r.save()
+}
+
 func (r *Run) RunTask(t *Task) error {
+	if err := r.ctx.Err(); err != nil {
+		if err == context.Canceled {
+			return ErrCancelled
+		}
+		return ErrTimeout
+	}
+	step := r.startStep(t)
+	err := r.runTask(t, step)
+	r.finishStep(step, err)
+	return err
+}
+
+func (r *Run) runTask(t *Task, step int) error {
 	// only_if is be the first condition
 	if t.OnlyIf != "" {
 		cmd := r.Interpolate(t.OnlyIf, r.MakeEnv(t.Vars))
-		output, exitCode, err := localRun(cmd, r.MakeEnv(t.Vars), t.Cd)
 		r.logInfo("Running command", cmd)
-		r.ExitCode = exitCode
-		r.logOutput(string(output))
+		r.startSpan("only_if", nil)
+		stdout, stderr := r.liveOutput("STDOUT"), r.liveOutput("STDERR")
+		_, exitCode, err := localRun(r.ctx, cmd, r.MakeEnv(t.Vars), t.Cd, t.timeout(), stdout, stderr)
+		stdout.Flush()
+		stderr.Flush()
+		r.update(func() { r.ExitCode = exitCode })
+		r.setSpanAttribute("nombda.exit_code", exitCode)
+		switch err {
+		case ErrTimeout:
+			r.endSpan(err)
+			r.logTimeout(t)
+			return err
+		case ErrCancelled:
+			// the condition was not answered, the step is not skipped
+			r.endSpan(err)
+			return err
+		}
+		r.endSpan(nil)
 		if err != nil {
+			r.setSpanAttribute("nombda.skip_reason", fmt.Sprintf("only_if exited with code %d", exitCode))
 			r.logInfo("Skipping step", t.Name)
+			r.update(func() { r.Steps[step].Skipped = true })
 			return nil
 		}
 	}
 	// run handler module
 	if t.HandlerName != "" {
-		err := r.RunHandler(t, t.HandlerName)
+		attempts, err := r.retry(t, func(attempt int) error {
+			return r.RunHandler(t, t.HandlerName)
+		})
+		r.update(func() { r.Steps[step].Attempts = attempts })
 		if err != nil {
+			if r.isCancelled() && !r.recoverable(t) {
+				return err
+			}
 			if t.OnFailure != "" {
 				r.logInfo("Recovering error in handler", t.HandlerName, "with handler", t.OnFailure)
 				err := r.RunHandler(t, t.OnFailure)
@@ -317,12 +916,14 @@ func (r *Run) RunTask(t *Task) error {
 						return err
 					}
 					r.logInfo("Continue after failure of handler", t.OnFailure)
+					r.continueAfterFailure(t)
 					return nil
 				}
 			} else {
 				if !t.ContinueAfterFailure {
 					return err
 				}
+				r.continueAfterFailure(t)
 				return nil
 			}
 		}
@@ -332,13 +933,27 @@ func (r *Run) RunTask(t *Task) error {
 	if t.Command != "" {
 		r.logInfo("Step command", t.Name)
 		cmd := r.Interpolate(t.Command, r.MakeEnv(t.Vars))
-		r.logInfo("Running command", cmd)
-		output, exitCode, err := localRun(cmd, r.MakeEnv(t.Vars), t.Cd)
-		r.ExitCode = exitCode
-		r.logOutput(string(output))
-		if t.Register != "" {
-			r.Registers[t.Register] = strings.TrimSpace(string(output))
-		}
+		r.update(func() { r.Steps[step].Command = r.hideSecrets(cmd) })
+		attempts, err := r.retry(t, func(attempt int) (err error) {
+			r.logInfo("Running command", cmd)
+			r.startSpan("command", map[string]interface{}{"nombda.attempt": attempt})
+			defer func() { r.endSpan(err) }()
+			stdout, stderr := r.liveOutput("STDOUT"), r.liveOutput("STDERR")
+			output, exitCode, err := localRun(r.ctx, cmd, r.MakeEnv(t.Vars), t.Cd, t.timeout(), stdout, stderr)
+			stdout.Flush()
+			stderr.Flush()
+			r.update(func() { r.ExitCode = exitCode })
+			r.setSpanAttribute("nombda.exit_code", exitCode)
+			if err == ErrTimeout {
+				r.logTimeout(t)
+				return err
+			}
+			if t.Register != "" {
+				r.update(func() { r.Registers[t.Register] = strings.TrimSpace(t.registered(output)) })
+			}
+			return err
+		})
+		r.update(func() { r.Steps[step].Attempts = attempts })
 		// command is in error
 		// call handler to catch error
 		if err != nil {
@@ -398,45 +1013,328 @@ func (r *Run) RunTask(t *Task) error {
 }
 
 func (h *Hook) AsyncRun(run *Run) {
-	defer func() {
-		run.Completed = true
-		run.logInfo(fmt.Sprintf("Job %s completed with exit code %d", run.ID, run.ExitCode))
-	}()
-	runs[run.ID] = run
-	run.logInfo("Starting job", run.ID)
+	if h.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(run.ctx, time.Duration(h.Timeout)*time.Second)
+		defer cancel()
+		run.ctx = ctx
+	}
+	run.update(func() {
+		startedAt := time.Now()
+		run.StartedAt = &startedAt
+		run.Status = RunRunning
+	})
+	run.metrics().runStarted(run.HookName, run.Action)
+	run.startSpan("run "+run.HookName+"/"+run.Action, map[string]interface{}{
+		"nombda.run_id": run.ID,
+		"nombda.hook":   run.HookName,
+		"nombda.action": run.Action,
+	})
+	run.emit(Event{Type: EventRunStarted, Level: "INFO", Message: "Starting job " + run.ID})
+	run.save()
+	run.finish(h.runTasks(run))
+}
+
+// runTasks runs every task of the hook and returns the status the run ends
+// with.
+func (h *Hook) runTasks(run *Run) RunStatus {
 	for _, task := range h.Tasks {
+		if run.isCancelled() {
+			return RunCancelled
+		}
 		err := run.RunTask(task)
-		if err != nil {
-			if task.ContinueAfterFailure {
-				run.logInfo("Continue after failure of task", task.Name)
-				continue
-			}
-			return
+		if err == nil {
+			continue
+		}
+		if !run.isCancelled() && run.ctx.Err() == nil && task.ContinueAfterFailure {
+			run.logInfo("Continue after failure of task", task.Name)
+			run.continueAfterFailure(task)
+			continue
 		}
+		run.update(func() { run.FailedTask = task.label() })
+		switch {
+		case run.isCancelled():
+			return RunCancelled
+		case errors.Is(err, ErrTimeout), run.ctx.Err() == context.DeadlineExceeded:
+			return RunTimedOut
+		default:
+			return RunFailed
+		}
+	}
+	if run.isCancelled() {
+		return RunCancelled
 	}
+	if run.FailedTask != "" {
+		return RunSucceededWithFailures
+	}
+	return RunSucceeded
+}
+
+// continueAfterFailure records a failure of t which did not stop the run.
+func (r *Run) continueAfterFailure(t *Task) {
+	r.update(func() {
+		if r.FailedTask == "" {
+			r.FailedTask = t.label()
+		}
+	})
+}
+
+func (r *Run) finish(status RunStatus) {
+	exitCode := r.ExitCode
+	e := Event{Type: EventRunFinished, ExitCode: &exitCode, Status: status}
+	switch status {
+	case RunSucceeded:
+		e.Level = "INFO"
+		e.Message = fmt.Sprintf("Job %s completed with exit code %d", r.ID, exitCode)
+	default:
+		e.Level = "ERROR"
+		e.Message = fmt.Sprintf("Job %s %s with exit code %d", r.ID, status, exitCode)
+	}
+	r.emit(e)
+	outputs := r.evaluateOutputs()
+	r.update(func() {
+		finishedAt := time.Now()
+		r.FinishedAt = &finishedAt
+		r.Status = status
+		r.Outputs = outputs
+	})
+	r.metrics().runFinished(r.HookName, r.Action, status, r.FinishedAt.Sub(*r.StartedAt))
+	r.setSpanAttribute("nombda.status", string(status))
+	r.setSpanAttribute("nombda.exit_code", exitCode)
+	if status == RunSucceeded {
+		r.endSpan(nil)
+	} else {
+		r.endSpan(errors.New(e.Message))
+	}
+	r.exportSpans()
+	r.Output.Close()
+	r.save()
+	r.Hook.HookEngine.audit(AuditEntry{
+		Type:     AuditRunFinished,
+		Token:    r.trigger.Token,
+		SourceIP: r.trigger.SourceIP,
+		Hook:     r.HookName,
+		Action:   r.Action,
+		RunID:    r.ID,
+		Outcome:  status,
+	})
+	close(r.done)
+	r.mu.RLock()
+	cancel := r.cancel
+	r.mu.RUnlock()
+	// release the resources of the run context
+	cancel()
+	r.Hook.HookEngine.concurrency.done(r)
+	r.notify()
+}
+
+// evaluateOutputs interpolates the outputs declared by the hook with the
+// values the run ends with. Secrets are masked in the values.
+func (r *Run) evaluateOutputs() map[string]string {
+	if len(r.Hook.Outputs) == 0 {
+		return nil
+	}
+	var replacers []string
+	for k, v := range r.MakeEnv(nil) {
+		replacers = append(replacers, fmt.Sprintf("${var.%s}", k), v)
+	}
+	for k, v := range r.Secrets {
+		replacers = append(replacers, fmt.Sprintf("${secret.%s}", k), v)
+	}
+	re := strings.NewReplacer(replacers...)
+	outputs := make(map[string]string, len(r.Hook.Outputs))
+	for name, expr := range r.Hook.Outputs {
+		outputs[name] = r.hideSecrets(re.Replace(expr))
+	}
+	return outputs
+}
+
+// Wait blocks until the run is over or ctx is done, and reports whether the
+// run is over.
+func (r *Run) Wait(ctx context.Context) bool {
+	if r.done == nil {
+		// run loaded from a store, it is not running in this process
+		return r.State().Status.Terminal()
+	}
+	select {
+	case <-r.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// label names the task in logs and run results.
+func (t *Task) label() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.HandlerName
 }
 func (r *Run) Log() string {
-	return r.Output
+	return r.Output.String()
 }
 
-func (h *Hook) Run() (*Run, error) {
-	run, err := NewRun(h)
+// Trigger holds what the caller gives when triggering a hook.
+type Trigger struct {
+	Vars map[string]string
+	// CallbackURL is notified when the run finishes, in addition to the
+	// hook notify URLs.
+	CallbackURL string
+	// Token and SourceIP tell who triggered the run, for the audit log.
+	Token    string
+	SourceIP string
+	// Traceparent is the W3C traceparent header of the caller, continued by
+	// the run trace.
+	Traceparent string
+}
+
+// Run starts a run of the hook in the background with vars given by the
+// caller, which override the hook vars. Vars are checked against the hook
+// params, a *ParamsError lists the invalid ones.
+func (h *Hook) Run(vars map[string]string) (*Run, error) {
+	return h.RunTrigger(Trigger{Vars: vars})
+}
+
+// RunTrigger starts a run of the hook in the background like Run.
+func (h *Hook) RunTrigger(t Trigger) (*Run, error) {
+	if t.CallbackURL != "" {
+		if err := checkCallbackURL(t.CallbackURL); err != nil {
+			return nil, err
+		}
+	}
+	vars, err := h.CheckParams(t.Vars)
 	if err != nil {
 		return nil, err
 	}
-	go h.AsyncRun(run)
+	if err := h.checkVars(vars); err != nil {
+		return nil, err
+	}
+	run, previous, err := h.startRun(t, vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range previous {
+		// the run may be over already
+		p.Cancel()
+	}
 	return run, nil
+}
+
+// startRun creates the run of a trigger and starts it, or queues it behind
+// the runs of its concurrency group. It returns the runs in progress the
+// cancel_previous policy replaces.
+func (h *Hook) startRun(t Trigger, vars map[string]string) (*Run, []*Run, error) {
+	groups := &h.HookEngine.concurrency
+	group := h.concurrencyGroup(vars)
+	var previous []*Run
+	if group != "" {
+		// the lock is kept until the run joins its group so concurrent
+		// triggers see each other
+		groups.mu.Lock()
+		defer groups.mu.Unlock()
+		previous = append(previous, groups.runs[group]...)
+		if h.Concurrency == ConcurrencySkip && len(previous) > 0 {
+			return nil, nil, ErrRunInProgress
+		}
+	}
+	queue := h.HookEngine.Queue
+	if queue != nil {
+		if err := queue.reserve(); err != nil {
+			return nil, nil, err
+		}
+	}
+	run, err := NewRun(h)
+	if err != nil {
+		if queue != nil {
+			queue.release()
+		}
+		return nil, nil, err
+	}
+	run.Vars = vars
+	run.trigger = t
+	if sc, ok := ParseTraceparent(t.Traceparent); ok && run.tracing() {
+		run.TraceID = sc.TraceID
+		run.parentSpanID = sc.SpanID
+	}
+	h.HookEngine.audit(AuditEntry{
+		Type:     AuditRunTriggered,
+		Token:    t.Token,
+		SourceIP: t.SourceIP,
+		Hook:     h.Name,
+		Action:   h.Action,
+		Params:   run.hideSecretsMap(vars),
+		RunID:    run.ID,
+		Outcome:  RunQueued,
+	})
+	if group == "" {
+		h.start(run)
+		return run, nil, nil
+	}
+	run.concurrencyGroup = group
+	if groups.add(run) {
+		h.start(run)
+	}
+	if h.Concurrency != ConcurrencyCancelPrevious {
+		previous = nil
+	}
+	return run, previous, nil
+}
 
+// start runs the run in the background, once a worker is free if the
+// engine has a run queue.
+func (h *Hook) start(run *Run) {
+	if h.HookEngine.Queue != nil {
+		h.HookEngine.Queue.submit(run)
+		return
+	}
+	go h.AsyncRun(run)
 }
 
+// GetRun returns the run of the hook action with the given id. Runs of other
+// hooks or actions are not found.
 func (h *Hook) GetRun(id string) (*Run, error) {
-	run, ok := runs[id]
-	if !ok {
-		return nil, fmt.Errorf("run id not found")
+	run, err := h.HookEngine.Store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if run.HookName != h.Name || run.Action != h.Action {
+		return nil, ErrRunNotFound
 	}
 	return run, nil
 }
 
+// Cancel stops the run: the running command and its whole process group are
+// killed and no further task is started.
+func (r *Run) Cancel() error {
+	r.mu.Lock()
+	if r.Status.Terminal() {
+		r.mu.Unlock()
+		return fmt.Errorf("run already completed")
+	}
+	r.cancelled = true
+	cancel := r.cancel
+	r.mu.Unlock()
+	r.logError("Cancelling job", r.ID)
+	cancel()
+	if r.Hook == nil {
+		return nil
+	}
+	// a queued run is finished right away instead of waiting for a worker
+	// or for a previous run of its concurrency group
+	e := r.Hook.HookEngine
+	switch {
+	case e.concurrency.remove(r):
+		if e.Queue != nil {
+			// give back the place taken in the run queue
+			e.Queue.release()
+		}
+		go r.Hook.AsyncRun(r)
+	case e.Queue != nil && e.Queue.remove(r):
+		go r.Hook.AsyncRun(r)
+	}
+	return nil
+}
+
 func (r *Run) InjectSecrets(secrets map[string]string) {
 	r.Secrets = secrets
 }
@@ -1,8 +1,14 @@
 package engine
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -10,7 +16,28 @@ var (
 )
 
 func setup() {
-	e = NewHookEngine("")
+	e = NewHookEngine("", nil)
+}
+
+// stdoutLines returns the command output lines of the run log, without their
+// timestamp and stream tag.
+func stdoutLines(r *Run) []string {
+	var lines []string
+	for _, line := range strings.Split(r.Log(), "\n") {
+		if i := strings.Index(line, " [STDOUT] "); i >= 0 {
+			lines = append(lines, line[i+len(" [STDOUT] "):])
+		}
+	}
+	return lines
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nombda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
 }
 
 func TestHookOnlyIf(t *testing.T) {
@@ -93,13 +120,23 @@ func TestHookCommandFailure(t *testing.T) {
 		t.Fatal(err)
 	}
 	h.AsyncRun(r)
+	outputS := r.Status
+	expectedS := RunFailed
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	output := r.FailedTask
+	expected := "failure"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
 	outputInt := r.ExitCode
 	expectedInt := 2
 	if outputInt != expectedInt {
 		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
 	}
-	output := r.Registers["bar"]
-	expected := "foo"
+	output = r.Registers["bar"]
+	expected = "foo"
 	if output != expected {
 		t.Fatalf("want %+v, got %+v", expected, output)
 	}
@@ -210,6 +247,11 @@ func TestHookHandlerOnFailureContinueAfterFailure(t *testing.T) {
 	if outputInt != expectedInt {
 		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
 	}
+	outputS := r.Status
+	expectedS := RunSucceededWithFailures
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
 	output := r.Registers["a"]
 	expected := "1"
 	if output != expected {
@@ -257,14 +299,21 @@ func TestHookCommandSecret(t *testing.T) {
 	if output != expected {
 		t.Fatalf("want %+v, got %+v", expected, output)
 	}
-	for _, line := range strings.Split(r.Log(), "\n") {
-		if strings.HasPrefix(line, "secret:") {
-			output := line
-			expected := "secret:***"
-			if output != expected {
-				t.Fatalf("want %+v, got %+v", expected, output)
-			}
-		}
+	output = stdoutLines(r)[0]
+	expected = "secret:***"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.State().Registers["foo"]
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret:123") {
+		t.Fatalf("want secret masked in run JSON, got %s", data)
 	}
 }
 
@@ -290,13 +339,828 @@ func TestHookInjectSecret(t *testing.T) {
 	if output != expected {
 		t.Fatalf("want %+v, got %+v", expected, output)
 	}
-	for _, line := range strings.Split(r.Log(), "\n") {
-		if strings.HasPrefix(line, "secret:") {
-			output := line
-			expected := "secret:***"
-			if output != expected {
-				t.Fatalf("want %+v, got %+v", expected, output)
-			}
-		}
+	output = stdoutLines(r)[0]
+	expected = "secret:***"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookRetry(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.GlobalVars = map[string]string{"dir": tempDir(t)}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputInt := r.ExitCode
+	expectedInt := 0
+	if outputInt != expectedInt {
+		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
+	}
+	output := r.Registers["attempts"]
+	expected := "3"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookRetryFails(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_retry_fails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputInt := r.ExitCode
+	expectedInt := 3
+	if outputInt != expectedInt {
+		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
+	}
+	if !strings.Contains(r.Log(), "Attempt 2/2") {
+		t.Fatalf("want second attempt in log, got %+v", r.Log())
+	}
+	output := r.Registers["bar"]
+	expected := ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookRetryIntervalCancel(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_retry_interval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the run waits 60s before its second attempt
+	cancelAfter(t, h, r, 200*time.Millisecond)
+	outputS := r.Status
+	expectedS := RunCancelled
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if strings.Contains(r.Log(), "Attempt 2/4") {
+		t.Fatalf("want no second attempt in log, got %+v", r.Log())
+	}
+}
+
+func TestHookRetryIntervalTimeout(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_retry_interval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hook timeout expires while the run waits for its second attempt
+	h.Timeout = 1
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputS := r.Status
+	expectedS := RunTimedOut
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if !strings.Contains(r.Log(), "Hook timeout of 1s reached in step failing healthcheck") {
+		t.Fatalf("want hook timeout in log, got %+v", r.Log())
+	}
+	output := r.FailedTask
+	expected := "failing healthcheck"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookRetryHandler(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_retry_handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.GlobalVars = map[string]string{"dir": tempDir(t)}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputInt := r.ExitCode
+	expectedInt := 0
+	if outputInt != expectedInt {
+		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
+	}
+	output := r.Registers["bar"]
+	expected := "foo"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookTaskTimeout(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_task_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputS := r.Status
+	expectedS := RunTimedOut
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if !strings.Contains(r.Log(), "Timeout of 1s reached in step too slow") {
+		t.Fatalf("want timeout in log, got %+v", r.Log())
+	}
+	output := r.Registers["bar"]
+	expected := ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_hook_timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputS := r.Status
+	expectedS := RunTimedOut
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if !strings.Contains(r.Log(), "Hook timeout of 1s reached") {
+		t.Fatalf("want hook timeout in log, got %+v", r.Log())
+	}
+	output := r.Registers["bar"]
+	expected := ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func cancelAfter(t *testing.T, h *Hook, r *Run, d time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		h.AsyncRun(r)
+		close(done)
+	}()
+	time.Sleep(d)
+	if err := r.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not stopped after cancellation")
+	}
+}
+
+func TestHookCancel(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelAfter(t, h, r, 500*time.Millisecond)
+	outputS := r.Status
+	expectedS := RunCancelled
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	output := r.Registers["rollback"]
+	expected := ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.Registers["bar"]
+	expected = ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	if err := r.Cancel(); err == nil {
+		t.Fatal("want error when cancelling a completed run")
+	}
+}
+
+func TestHookCancelOnlyIf(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel_only_if")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelAfter(t, h, r, 300*time.Millisecond)
+	outputS := r.Status
+	expectedS := RunCancelled
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if r.Steps[0].Skipped {
+		t.Fatalf("want step not skipped, got %+v", r.Steps[0])
+	}
+	if strings.Contains(r.Log(), "Skipping step") {
+		t.Fatalf("want no skipped step in log, got %+v", r.Log())
+	}
+	output := r.FailedTask
+	expected := "slow condition"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookCancelOnFailure(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel_on_failure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelAfter(t, h, r, 500*time.Millisecond)
+	outputS := r.Status
+	expectedS := RunCancelled
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	output := r.Registers["rollback"]
+	expected := "rolled back"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.Registers["bar"]
+	expected = ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookCancelOnFailureTimeout(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel_slow_rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rollback is stopped by the 2s hook timeout
+	cancelAfter(t, h, r, 200*time.Millisecond)
+	if !strings.Contains(r.Log(), "Running handler rollback after cancellation") {
+		t.Fatalf("want rollback in log, got %+v", r.Log())
+	}
+	output := r.FinishedAt.Sub(*r.StartedAt) < 5*time.Second
+	if !output {
+		t.Fatalf("want rollback stopped by the hook timeout, took %s", r.FinishedAt.Sub(*r.StartedAt))
+	}
+}
+
+func TestHookCancelOnFailureTwice(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel_slow_rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.AsyncRun(r)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := r.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	// a second cancellation stops the rollback
+	if err := r.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("rollback not stopped by the second cancellation")
+	}
+	outputS := r.State().Status
+	expectedS := RunCancelled
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+}
+
+func TestHookOnFailureOnCancelCommand(t *testing.T) {
+	setup()
+	if _, err := e.ReadHook("tests/hooks", "invalid", "on_failure_on_cancel"); err == nil {
+		t.Fatal("want error for on_failure_on_cancel on a command task")
+	}
+}
+
+func TestHookRunStatus(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputS := r.Status
+	expectedS := RunQueued
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	h.AsyncRun(r)
+	outputS = r.Status
+	expectedS = RunSucceeded
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if r.StartedAt == nil || r.FinishedAt == nil || r.FinishedAt.Before(*r.StartedAt) {
+		t.Fatalf("want start and finish timestamps, got %+v and %+v", r.StartedAt, r.FinishedAt)
+	}
+	output := r.FailedTask
+	expected := ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookSteps(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	expected := []StepResult{
+		{Name: "test1", Attempts: 1},
+		{Name: "1", HandlerPath: "test1", Command: "echo bar", Attempts: 1},
+		{Name: "test2", HandlerPath: "test1", Attempts: 1},
+		{Name: "2", HandlerPath: "test1 > test2", Command: "echo foo", Attempts: 1},
+	}
+	if len(r.Steps) != len(expected) {
+		t.Fatalf("want %+v, got %+v", expected, r.Steps)
+	}
+	for i, step := range r.Steps {
+		step.StartedAt = time.Time{}
+		step.Duration = 0
+		if step != expected[i] {
+			t.Fatalf("want %+v, got %+v", expected[i], step)
+		}
+	}
+}
+
+func TestHookStepsSkippedAndRetried(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_only_if")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputB := r.Steps[0].Skipped
+	expectedB := true
+	if outputB != expectedB {
+		t.Fatalf("want %+v, got %+v", expectedB, outputB)
+	}
+	outputB = r.Steps[1].Skipped
+	expectedB = false
+	if outputB != expectedB {
+		t.Fatalf("want %+v, got %+v", expectedB, outputB)
+	}
+
+	h, err = e.ReadHook("tests/hooks", "tests", "test_retry_fails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	outputInt := r.Steps[0].Attempts
+	expectedInt := 2
+	if outputInt != expectedInt {
+		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
+	}
+	outputInt = r.Steps[0].ExitCode
+	expectedInt = 3
+	if outputInt != expectedInt {
+		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
+	}
+}
+
+func TestHookStepsHideSecrets(t *testing.T) {
+	setup()
+	e.Secrets["foo"] = "bar"
+	h, err := e.ReadHook("tests/hooks", "tests", "test_command_global_vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	output := r.Steps[0].Command
+	expected := "echo ***"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookConcurrentRuns(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		r, err := h.Run(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, r.ID)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for {
+			r, err := h.GetRun(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state := r.State()
+			r.Log()
+			if state.Status.Terminal() {
+				output := state.Registers["bar"]
+				expected := "foo"
+				if output != expected {
+					t.Fatalf("want %+v, got %+v", expected, output)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("run %s not completed", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestHookGetRunOtherHook(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := e.ReadHook("tests/hooks", "tests", "test_register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := other.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Wait(context.Background())
+	if _, err := other.GetRun(r.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.GetRun(r.ID); err != ErrRunNotFound {
+		t.Fatalf("want %+v, got %+v", ErrRunNotFound, err)
+	}
+}
+
+func TestHookLiveOutput(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_live_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.AsyncRun(r)
+	var lines []string
+	closed := false
+	for !closed && len(lines) < 1 {
+		var events []Event
+		var changed <-chan struct{}
+		events, closed, changed = r.Output.Since(0)
+		lines = nil
+		for _, e := range events {
+			if e.Type == EventCommandOutput {
+				lines = append(lines, e.Message)
+			}
+		}
+		if !closed && len(lines) < 1 {
+			<-changed
+		}
+	}
+	expected := []string{"first"}
+	if closed || strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("want %+v streamed before the command ends, got %+v", expected, lines)
+	}
+	for !closed {
+		var changed <-chan struct{}
+		_, closed, changed = r.Output.Since(0)
+		if !closed {
+			<-changed
+		}
+	}
+	output := strings.Join(stdoutLines(r), "\n")
+	expectedS := "first\nsecond"
+	if output != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, output)
+	}
+	output = r.State().Registers["output"]
+	if output != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, output)
+	}
+}
+
+func TestHookRegisterStream(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_register_stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	output := r.Registers["default"]
+	expected := "out"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.Registers["err"]
+	expected = "warning"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.Registers["both"]
+	expected = "out\nwarning"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(r.Log()), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 {
+			t.Fatalf("want timestamp and tag, got %+v", line)
+		}
+		if _, err := time.Parse(logTimeFormat, fields[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(r.Log(), " [STDERR] warning\n") {
+		t.Fatalf("want stderr line in log, got %+v", r.Log())
+	}
+}
+
+func TestHookRegisterStreamInvalid(t *testing.T) {
+	setup()
+	_, err := e.ReadHook("tests/hooks", "invalid", "register_stream")
+	if err == nil {
+		t.Fatal("want error for unknown register_stream")
+	}
+}
+
+func TestHookEvents(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+	var types []string
+	for _, e := range r.Output.Events() {
+		if e.RunID != r.ID || e.Hook != "tests" || e.Action != "test_handler" {
+			t.Fatalf("want run fields on event, got %+v", e)
+		}
+		if e.Type != EventMessage {
+			types = append(types, string(e.Type))
+		}
+	}
+	output := strings.Join(types, " ")
+	expected := "run_started step_started handler_entered step_started command_output step_finished " +
+		"step_started handler_entered step_started command_output step_finished step_finished step_finished run_finished"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	events := r.Output.Events()
+	last := events[len(events)-1]
+	if last.Status != RunSucceeded || last.ExitCode == nil || *last.ExitCode != 0 {
+		t.Fatalf("want succeeded run_finished event, got %+v", last)
+	}
+	for _, e := range events {
+		if e.Type == EventCommandOutput && e.Message == "foo" {
+			if e.Task != "2" || e.HandlerPath != "test1 > test2" {
+				t.Fatalf("want task 2 in test1 > test2, got %+v", e)
+			}
+		}
+	}
+}
+
+func TestHookTriggerVars(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_trigger_vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Vars = map[string]string{"image_tag": "v1.2.3; echo injected"}
+	h.AsyncRun(r)
+	output := r.Registers["tag"]
+	expected := "v1.2.3; echo injected"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.Registers["env"]
+	expected = "prod"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = r.Registers["pinned"]
+	expected = "pinned"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookWait(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if r.Wait(ctx) {
+		t.Fatalf("want run still going after timeout, got %+v", r.State().Status)
+	}
+	if err := r.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !r.Wait(ctx) {
+		t.Fatal("run not over after cancellation")
+	}
+	output := r.State().Status
+	expected := RunCancelled
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookOutputs(t *testing.T) {
+	setup()
+	e.Secrets["foo"] = "s3cr3t"
+	h, err := e.ReadHook("tests/hooks", "tests", "test_outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Wait(context.Background()) {
+		t.Fatal("run not over")
+	}
+	output := r.State().Outputs
+	expected := map[string]string{
+		"git_sha":  "abc123",
+		"url":      "https://staging.example.com/abc123",
+		"token":    "token:***",
+		"password": "***",
+	}
+	if !reflect.DeepEqual(output, expected) {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestHookOutputsInvalid(t *testing.T) {
+	setup()
+	_, err := e.ReadHook("tests/hooks", "invalid", "outputs_name")
+	if err == nil {
+		t.Fatal("want error for invalid output name")
+	}
+}
+
+func TestReadHookInvalidID(t *testing.T) {
+	setup()
+	for _, id := range [][2]string{{"..", "tests"}, {"tests", "../tests/test_register"}, {"tests/..", "test_register"}, {"", "test_register"}, {".tests", "test_register"}} {
+		if _, err := e.ReadHook("tests/hooks", id[0], id[1]); err == nil || err == ErrHookNotFound {
+			t.Fatalf("want invalid id error for %s/%s, got %+v", id[0], id[1], err)
+		}
+	}
+	_, err := e.ReadHook("tests/hooks", "tests", "missing")
+	if err != ErrHookNotFound {
+		t.Fatalf("want %+v, got %+v", ErrHookNotFound, err)
+	}
+}
+
+func TestReadHookOutsideConfigDir(t *testing.T) {
+	setup()
+	dir := tempDir(t)
+	outside := tempDir(t)
+	if err := ioutil.WriteFile(outside+"/secret.yml", []byte("tasks: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/foo", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside+"/secret.yml", dir+"/foo/bar.yml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ReadHook(dir, "foo", "bar"); err == nil {
+		t.Fatal("want error for action file outside of the config directory")
+	}
+	// symlinks inside the config directory are followed
+	if err := ioutil.WriteFile(dir+"/foo/real.yml", []byte("tasks: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir+"/foo/real.yml", dir+"/foo/link.yml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ReadHook(dir, "foo", "link"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadHookOutsideEngineConfigDir(t *testing.T) {
+	setup()
+	e.ConfigDir = "tests"
+	// path inside the engine config directory
+	if _, err := e.ReadHook("tests/hooks", "tests", "test_register"); err != nil {
+		t.Fatal(err)
+	}
+	dir := tempDir(t)
+	if err := os.Mkdir(dir+"/foo", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/foo/bar.yml", []byte("tasks: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ReadHook(dir, "foo", "bar"); err == nil {
+		t.Fatal("want error for path outside of the engine config directory")
 	}
 }
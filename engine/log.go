@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// EventType is the kind of a run log event.
+type EventType string
+
+const (
+	EventRunStarted     EventType = "run_started"
+	EventRunFinished    EventType = "run_finished"
+	EventStepStarted    EventType = "step_started"
+	EventStepFinished   EventType = "step_finished"
+	EventHandlerEntered EventType = "handler_entered"
+	EventCommandOutput  EventType = "command_output"
+	// EventMessage is a free-form message from nombda, e.g. a retry or a
+	// skipped step.
+	EventMessage EventType = "message"
+)
+
+// Event is an entry of a run log.
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        EventType `json:"type"`
+	RunID       string    `json:"run_id"`
+	Hook        string    `json:"hook"`
+	Action      string    `json:"action"`
+	Task        string    `json:"task,omitempty"`
+	HandlerPath string    `json:"handler_path,omitempty"`
+	Handler     string    `json:"handler,omitempty"`
+	// Level is INFO or ERROR for messages from nombda, Stream is STDOUT or
+	// STDERR for command output.
+	Level    string    `json:"level,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Status   RunStatus `json:"status,omitempty"`
+}
+
+// Text renders the event as a line of the text log. Events without message,
+// apart from empty output lines, are not part of the text log.
+func (e Event) Text() string {
+	if e.Message == "" && e.Type != EventCommandOutput {
+		return ""
+	}
+	tag := e.Level
+	if e.Stream != "" {
+		tag = e.Stream
+	}
+	return fmt.Sprintf("%s [%s] %s\n", e.Time.UTC().Format(logTimeFormat), tag, e.Message)
+}
+
+// LogBuffer is an append-only log of events safe for concurrent use: a run
+// appends to it while API handlers read snapshots or follow it as it grows.
+type LogBuffer struct {
+	mu      sync.RWMutex
+	events  []Event
+	closed  bool
+	changed chan struct{}
+}
+
+func (b *LogBuffer) Append(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, e)
+	b.notify()
+}
+
+// Close marks the log as complete once the run is over.
+func (b *LogBuffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.notify()
+}
+
+func (b *LogBuffer) notify() {
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// String renders a snapshot of the log as text.
+func (b *LogBuffer) String() string {
+	var s strings.Builder
+	for _, e := range b.Events() {
+		s.WriteString(e.Text())
+	}
+	return s.String()
+}
+
+// Events returns a snapshot of the log events.
+func (b *LogBuffer) Events() []Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]Event(nil), b.events...)
+}
+
+// Len returns the number of events in the log.
+func (b *LogBuffer) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.events)
+}
+
+// Since returns the events appended after the first n ones, whether the log
+// is complete, and a channel closed on the next append or on close.
+func (b *LogBuffer) Since(n int) ([]Event, bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	if n > len(b.events) {
+		n = len(b.events)
+	}
+	return append([]Event(nil), b.events[n:]...), b.closed, b.changed
+}
+
+func (b *LogBuffer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.Events())
+}
+
+func (b *LogBuffer) UnmarshalJSON(data []byte) error {
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = events
+	return nil
+}
+
+// lineWriter passes each complete line written to it to log, without its
+// trailing newline. Flush passes the remaining incomplete line.
+type lineWriter struct {
+	log     func(string)
+	pending []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(string(w.pending[:i]))
+		w.pending = w.pending[i+1:]
+	}
+	w.pending = append([]byte(nil), w.pending...)
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.log(string(w.pending))
+		w.pending = nil
+	}
+}
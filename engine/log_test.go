@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := &LogBuffer{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Append(Event{Type: EventMessage, Level: "INFO", Message: "foo"})
+			_ = b.String()
+		}()
+	}
+	wg.Wait()
+	outputInt := b.Len()
+	expectedInt := 10
+	if outputInt != expectedInt {
+		t.Fatalf("want %+v, got %+v", expectedInt, outputInt)
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &LogBuffer{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	output := decoded.String()
+	expected := b.String()
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = strings.Split(output, "\n")[0]
+	expected = " [INFO] foo"
+	if !strings.HasSuffix(output, expected) {
+		t.Fatalf("want suffix %+v, got %+v", expected, output)
+	}
+}
+
+func TestEventText(t *testing.T) {
+	e := Event{
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC),
+		Type:    EventCommandOutput,
+		Stream:  "STDERR",
+		Message: "warning",
+	}
+	output := e.Text()
+	expected := "2020-01-02T03:04:05.006Z [STDERR] warning\n"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestEventTextWithoutMessage(t *testing.T) {
+	e := Event{Type: EventStepStarted, Task: "foo"}
+	output := e.Text()
+	expected := ""
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
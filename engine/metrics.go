@@ -0,0 +1,212 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the duration histograms.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// metric is a counter, gauge or histogram with labels, in the Prometheus
+// sense.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	// counts holds the cumulative bucket counts of histograms, value their
+	// sum.
+	counts []uint64
+	count  uint64
+}
+
+// Metrics counts what the engine does and writes it in the Prometheus text
+// exposition format. It is safe for concurrent use.
+type Metrics struct {
+	mu      sync.Mutex
+	metrics []*metric
+
+	runsStarted   *metric
+	runsFinished  *metric
+	runsRunning   *metric
+	runsQueued    *metric
+	runDuration   *metric
+	stepDuration  *metric
+	exitCodes     *metric
+	secretsMasked *metric
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.runsStarted = m.add("nombda_runs_started_total", "Runs started.", "counter", "hook", "action")
+	m.runsFinished = m.add("nombda_runs_finished_total", "Runs finished, by final status.", "counter", "hook", "action", "status")
+	m.runsRunning = m.add("nombda_runs_running", "Runs currently running.", "gauge", "hook", "action")
+	m.runsQueued = m.add("nombda_runs_queued", "Runs waiting to start.", "gauge", "hook", "action")
+	m.runDuration = m.add("nombda_run_duration_seconds", "Duration of finished runs.", "histogram", "hook", "action", "status")
+	m.stepDuration = m.add("nombda_step_duration_seconds", "Duration of executed steps.", "histogram", "hook", "action")
+	m.exitCodes = m.add("nombda_command_exit_codes_total", "Exit codes of executed commands.", "counter", "hook", "action", "exit_code")
+	m.secretsMasked = m.add("nombda_secret_replacements_total", "Secret values masked in logs, steps and outputs.", "counter")
+	return m
+}
+
+func (m *Metrics) add(name string, help string, kind string, labels ...string) *metric {
+	metric := &metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+	if kind == "histogram" {
+		metric.buckets = durationBuckets
+	}
+	m.metrics = append(m.metrics, metric)
+	return metric
+}
+
+// get returns the series of the label values, creating it if needed. It
+// must be called with the lock held.
+func (metric *metric) get(values ...string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := metric.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if metric.kind == "histogram" {
+			s.counts = make([]uint64, len(metric.buckets))
+		}
+		metric.series[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) inc(metric *metric, delta float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metric.get(values...).value += delta
+}
+
+func (m *Metrics) observe(metric *metric, d time.Duration, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := metric.get(values...)
+	seconds := d.Seconds()
+	for i, bound := range metric.buckets {
+		if seconds <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += seconds
+}
+
+// runQueued counts a run waiting to start.
+func (m *Metrics) runQueued(hook string, action string) {
+	if m == nil {
+		return
+	}
+	m.inc(m.runsQueued, 1, hook, action)
+}
+
+// runStarted counts a queued run which started.
+func (m *Metrics) runStarted(hook string, action string) {
+	if m == nil {
+		return
+	}
+	m.inc(m.runsQueued, -1, hook, action)
+	m.inc(m.runsStarted, 1, hook, action)
+	m.inc(m.runsRunning, 1, hook, action)
+}
+
+// runFinished counts a started run which finished.
+func (m *Metrics) runFinished(hook string, action string, status RunStatus, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.inc(m.runsRunning, -1, hook, action)
+	m.inc(m.runsFinished, 1, hook, action, string(status))
+	m.observe(m.runDuration, d, hook, action, string(status))
+}
+
+// stepFinished counts an executed step. exitCode is nil for steps which ran
+// no command.
+func (m *Metrics) stepFinished(hook string, action string, d time.Duration, exitCode *int) {
+	if m == nil {
+		return
+	}
+	m.observe(m.stepDuration, d, hook, action)
+	if exitCode != nil {
+		m.inc(m.exitCodes, 1, hook, action, strconv.Itoa(*exitCode))
+	}
+}
+
+// secretsReplaced counts secret values masked.
+func (m *Metrics) secretsReplaced(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.inc(m.secretsMasked, float64(n))
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	var b strings.Builder
+	for _, metric := range m.metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		keys := make([]string, 0, len(metric.series))
+		for key := range metric.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(metric.labels) == 0 && len(keys) == 0 {
+			fmt.Fprintf(&b, "%s 0\n", metric.name)
+		}
+		for _, key := range keys {
+			s := metric.series[key]
+			if metric.kind != "histogram" {
+				fmt.Fprintf(&b, "%s%s %s\n", metric.name, formatLabels(metric.labels, s.labels), formatValue(s.value))
+				continue
+			}
+			for i, bound := range metric.buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", metric.name, formatLabels(metric.labels, s.labels, "le", formatValue(bound)), s.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", metric.name, formatLabels(metric.labels, s.labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", metric.name, formatLabels(metric.labels, s.labels), formatValue(s.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", metric.name, formatLabels(metric.labels, s.labels), s.count)
+		}
+	}
+	m.mu.Unlock()
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
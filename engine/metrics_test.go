@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	setup()
+	e.Secrets["foo"] = "123"
+	for _, action := range []string{"test_command_secret", "test_command_continue_after_failure"} {
+		h, err := e.ReadHook("tests/hooks", "tests", action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := h.Run(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Wait(context.Background())
+	}
+	var b strings.Builder
+	if _, err := e.Metrics.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	output := b.String()
+	for _, expected := range []string{
+		"# TYPE nombda_runs_started_total counter\n",
+		`nombda_runs_started_total{hook="tests",action="test_command_secret"} 1` + "\n",
+		`nombda_runs_finished_total{hook="tests",action="test_command_secret",status="succeeded"} 1` + "\n",
+		`nombda_runs_finished_total{hook="tests",action="test_command_continue_after_failure",status="failed"} 1` + "\n",
+		`nombda_runs_running{hook="tests",action="test_command_secret"} 0` + "\n",
+		`nombda_runs_queued{hook="tests",action="test_command_secret"} 0` + "\n",
+		`nombda_run_duration_seconds_count{hook="tests",action="test_command_secret",status="succeeded"} 1` + "\n",
+		`nombda_run_duration_seconds_bucket{hook="tests",action="test_command_secret",status="succeeded",le="+Inf"} 1` + "\n",
+		`nombda_step_duration_seconds_count{hook="tests",action="test_command_secret"} 1` + "\n",
+		`nombda_command_exit_codes_total{hook="tests",action="test_command_secret",exit_code="0"} 1` + "\n",
+		`nombda_command_exit_codes_total{hook="tests",action="test_command_continue_after_failure",exit_code="2"} 2` + "\n",
+		"nombda_secret_replacements_total 1\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("want %+v, got %+v", expected, output)
+		}
+	}
+}
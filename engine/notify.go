@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of a callback body, as
+	// "sha256=<hex>".
+	SignatureHeader = "X-Nombda-Signature"
+
+	callbackAttempts = 5
+	callbackLogLines = 20
+)
+
+var (
+	// callbackBackoff is the wait before the first callback retry, doubled
+	// after each attempt.
+	callbackBackoff = time.Second
+	callbackClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Notify is a URL the run summary is posted to when a run of the hook
+// finishes.
+type Notify struct {
+	URL string `yaml:"url"`
+	// Secret names the nombda secret used as HMAC key to sign the payload.
+	// The engine callback secret is used if empty.
+	Secret string `yaml:"secret"`
+}
+
+// Callback is the payload posted to callback URLs when a run finishes.
+type Callback struct {
+	ID         string            `json:"id"`
+	Hook       string            `json:"hook"`
+	Action     string            `json:"action"`
+	Status     RunStatus         `json:"status"`
+	ExitCode   int               `json:"exit_code"`
+	StartedAt  *time.Time        `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at"`
+	Duration   time.Duration     `json:"duration"`
+	FailedTask string            `json:"failed_task"`
+	Outputs    map[string]string `json:"outputs"`
+	// Log holds the last lines of the run log.
+	Log string `json:"log"`
+}
+
+// checkCallbackURL ensures a callback URL is an absolute http(s) URL.
+func checkCallbackURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid callback URL %s", value)
+	}
+	return nil
+}
+
+// validateNotify checks the notify block of the hook.
+func (h *Hook) validateNotify() error {
+	for _, n := range h.Notify {
+		if err := checkCallbackURL(n.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sign returns the signature header value of a callback body.
+func Sign(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// callback builds the payload of the run callbacks.
+func (r *Run) callback() Callback {
+	state := r.State()
+	c := Callback{
+		ID:         state.ID,
+		Hook:       state.HookName,
+		Action:     state.Action,
+		Status:     state.Status,
+		ExitCode:   state.ExitCode,
+		StartedAt:  state.StartedAt,
+		FinishedAt: state.FinishedAt,
+		FailedTask: state.FailedTask,
+		Outputs:    state.Outputs,
+	}
+	if state.StartedAt != nil && state.FinishedAt != nil {
+		c.Duration = state.FinishedAt.Sub(*state.StartedAt)
+	}
+	lines := strings.SplitAfter(r.Log(), "\n")
+	if len(lines) > callbackLogLines+1 {
+		lines = lines[len(lines)-callbackLogLines-1:]
+	}
+	c.Log = strings.Join(lines, "")
+	return c
+}
+
+// notify posts the run summary to the hook notify URLs and to the callback
+// URL given by the caller. Deliveries are done in the background.
+func (r *Run) notify() {
+	targets := append([]*Notify(nil), r.Hook.Notify...)
+	if r.trigger.CallbackURL != "" {
+		targets = append(targets, &Notify{URL: r.trigger.CallbackURL})
+	}
+	if len(targets) == 0 {
+		return
+	}
+	body, err := json.Marshal(r.callback())
+	if err != nil {
+		log.Errorf("Unable to encode callback of run %s: %s", r.ID, err)
+		return
+	}
+	for _, n := range targets {
+		key := r.Hook.HookEngine.CallbackSecret
+		if n.Secret != "" {
+			var ok bool
+			if key, ok = r.Secrets[n.Secret]; !ok {
+				log.Errorf("Unable to sign callback of run %s to %s: unknown secret %s", r.ID, n.URL, n.Secret)
+				continue
+			}
+		}
+		go r.deliver(n.URL, key, body)
+	}
+}
+
+// deliver posts body to url, retrying with exponential backoff until the
+// receiver answers with a 2xx status.
+func (r *Run) deliver(url string, key string, body []byte) {
+	backoff := callbackBackoff
+	for attempt := 1; ; attempt++ {
+		err := postCallback(url, key, body)
+		if err == nil {
+			log.Infof("Callback of run %s delivered to %s", r.ID, url)
+			return
+		}
+		if attempt == callbackAttempts {
+			log.Errorf("Unable to deliver callback of run %s to %s after %d attempts: %s", r.ID, url, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postCallback(url string, key string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(SignatureHeader, Sign(key, body))
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type callbackServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	received chan Callback
+}
+
+// newCallbackServer starts a server answering 500 to the first failures
+// requests, then sending the received callbacks to the received channel.
+func newCallbackServer(t *testing.T, failures int, key string) *callbackServer {
+	s := &callbackServer{failures: failures, received: make(chan Callback, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, req)
+		if len(s.requests) <= s.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if output, expected := req.Header.Get(SignatureHeader), Sign(key, body); output != expected {
+			t.Errorf("want %+v, got %+v", expected, output)
+		}
+		var c Callback
+		if err := json.Unmarshal(body, &c); err != nil {
+			t.Error(err)
+			return
+		}
+		s.received <- c
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *callbackServer) next(t *testing.T) Callback {
+	select {
+	case c := <-s.received:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not received")
+	}
+	return Callback{}
+}
+
+func TestHookNotify(t *testing.T) {
+	setup()
+	callbackBackoff = 10 * time.Millisecond
+	e.Secrets["foo"] = "s3cr3t"
+	e.Secrets["notify_key"] = "hook key"
+	e.CallbackSecret = "engine key"
+	hookServer := newCallbackServer(t, 2, "hook key")
+	callerServer := newCallbackServer(t, 0, "engine key")
+	h, err := e.ReadHook("tests/hooks", "tests", "test_outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Notify = []*Notify{{URL: hookServer.URL, Secret: "notify_key"}}
+	r, err := h.RunTrigger(Trigger{CallbackURL: callerServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Wait(context.Background()) {
+		t.Fatal("run not over")
+	}
+	for _, s := range []*callbackServer{hookServer, callerServer} {
+		c := s.next(t)
+		output := c.ID
+		expected := r.ID
+		if output != expected {
+			t.Fatalf("want %+v, got %+v", expected, output)
+		}
+		outputS := c.Status
+		expectedS := RunSucceeded
+		if outputS != expectedS {
+			t.Fatalf("want %+v, got %+v", expectedS, outputS)
+		}
+		output = c.Outputs["git_sha"]
+		expected = "abc123"
+		if output != expected {
+			t.Fatalf("want %+v, got %+v", expected, output)
+		}
+		if c.Duration <= 0 {
+			t.Fatalf("want positive duration, got %+v", c.Duration)
+		}
+		if c.Log != r.Log() {
+			t.Fatalf("want %+v, got %+v", r.Log(), c.Log)
+		}
+	}
+	hookServer.mu.Lock()
+	defer hookServer.mu.Unlock()
+	outputN := len(hookServer.requests)
+	expectedN := 3
+	if outputN != expectedN {
+		t.Fatalf("want %+v, got %+v", expectedN, outputN)
+	}
+}
+
+func TestHookNotifyInvalidURL(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.RunTrigger(Trigger{CallbackURL: "file:///etc/passwd"}); err == nil {
+		t.Fatal("want error for invalid callback URL")
+	}
+	if _, err := e.ReadHook("tests/hooks", "invalid", "notify_url"); err == nil {
+		t.Fatal("want error for invalid notify URL")
+	}
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Param declares a parameter the caller gives when triggering a hook.
+type Param struct {
+	// Type is one of string (default), int, bool or enum.
+	Type        string `yaml:"type"`
+	Required    bool   `yaml:"required"`
+	Default     string `yaml:"default"`
+	Description string `yaml:"description"`
+	// Pattern is a regular expression string values must match.
+	Pattern string `yaml:"pattern"`
+	// Values lists the values allowed for an enum.
+	Values  []string `yaml:"values"`
+	pattern *regexp.Regexp
+}
+
+// ParamsError lists every invalid parameter given to a hook.
+type ParamsError struct {
+	Violations []string
+}
+
+func (e *ParamsError) Error() string {
+	return fmt.Sprintf("Invalid params: %s", strings.Join(e.Violations, ", "))
+}
+
+// validateParams checks the params block of the hook.
+func (h *Hook) validateParams() error {
+	for name, p := range h.Params {
+		if !varNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid param name %s", name)
+		}
+		switch p.Type {
+		case "", "string":
+			if p.Pattern != "" {
+				re, err := regexp.Compile(p.Pattern)
+				if err != nil {
+					return fmt.Errorf("Invalid pattern for param %s: %s", name, err.Error())
+				}
+				p.pattern = re
+			}
+		case "int", "bool":
+		case "enum":
+			if len(p.Values) == 0 {
+				return fmt.Errorf("Missing values for enum param %s", name)
+			}
+		default:
+			return fmt.Errorf("Invalid type %s for param %s", p.Type, name)
+		}
+		if p.Pattern != "" && p.pattern == nil {
+			return fmt.Errorf("Pattern is only allowed for string param %s", name)
+		}
+		if p.Default != "" {
+			if _, err := p.check(p.Default); err != nil {
+				return fmt.Errorf("Invalid default for param %s: %s", name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// check validates a value given for the param and returns it normalized.
+func (p *Param) check(value string) (string, error) {
+	switch p.Type {
+	case "int":
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not an int", value)
+		}
+		return strconv.Itoa(i), nil
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a bool", value)
+		}
+		return strconv.FormatBool(b), nil
+	case "enum":
+		for _, v := range p.Values {
+			if v == value {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of %s", value, strings.Join(p.Values, ", "))
+	}
+	if p.pattern != nil && !p.pattern.MatchString(value) {
+		return "", fmt.Errorf("%q does not match %s", value, p.Pattern)
+	}
+	return value, nil
+}
+
+// CheckParams validates vars given by the caller against the params declared
+// by the hook and returns them with defaults applied. Hooks without params
+// accept any vars.
+func (h *Hook) CheckParams(vars map[string]string) (map[string]string, error) {
+	if len(h.Params) == 0 {
+		return vars, nil
+	}
+	var violations []string
+	checked := make(map[string]string)
+	for name, p := range h.Params {
+		value, ok := vars[name]
+		if !ok {
+			if p.Required {
+				violations = append(violations, fmt.Sprintf("%s: missing required param", name))
+			} else if p.Default != "" {
+				checked[name], _ = p.check(p.Default)
+			}
+			continue
+		}
+		value, err := p.check(value)
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+		checked[name] = value
+	}
+	for name := range vars {
+		if _, ok := h.Params[name]; !ok {
+			violations = append(violations, fmt.Sprintf("%s: unknown param", name))
+		}
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return nil, &ParamsError{Violations: violations}
+	}
+	return checked, nil
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckParams(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := h.CheckParams(map[string]string{"image_tag": "v1.2.3", "debug": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"image_tag": "v1.2.3",
+		"env":       "staging",
+		"replicas":  "2",
+		"debug":     "true",
+	}
+	if len(vars) != len(expected) {
+		t.Fatalf("want %+v, got %+v", expected, vars)
+	}
+	for k, v := range expected {
+		if vars[k] != v {
+			t.Fatalf("want %+v for %s, got %+v", v, k, vars[k])
+		}
+	}
+}
+
+func TestCheckParamsViolations(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.CheckParams(map[string]string{
+		"env":      "dev",
+		"replicas": "two",
+		"tag":      "v1.2.3",
+	})
+	var paramsErr *ParamsError
+	if !errors.As(err, &paramsErr) {
+		t.Fatalf("want ParamsError, got %+v", err)
+	}
+	output := strings.Join(paramsErr.Violations, "\n")
+	expected := `env: "dev" is not one of staging, prod
+image_tag: missing required param
+replicas: "two" is not an int
+tag: unknown param`
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+
+	_, err = h.CheckParams(map[string]string{"image_tag": "v1.2..3"})
+	if !errors.As(err, &paramsErr) {
+		t.Fatalf("want ParamsError, got %+v", err)
+	}
+	if _, err := h.Run(map[string]string{"image_tag": "v1.2..3"}); !errors.As(err, &paramsErr) {
+		t.Fatalf("want ParamsError, got %+v", err)
+	}
+}
+
+func TestHookParams(t *testing.T) {
+	setup()
+	h, err := e.ReadHook("tests/hooks", "tests", "test_params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := h.CheckParams(map[string]string{"image_tag": "v1.2.3", "env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Vars = vars
+	h.AsyncRun(r)
+	output := r.Registers["deploy"]
+	expected := "v1.2.3 prod 2"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestReadHookInvalidParams(t *testing.T) {
+	setup()
+	for _, action := range []string{"params_type", "params_default"} {
+		if _, err := e.ReadHook("tests/hooks", "invalid", action); err == nil {
+			t.Fatalf("want error for invalid/%s", action)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueFull is returned when triggering a run while every worker is busy
+// and the run queue is full.
+var ErrQueueFull = errors.New("run queue is full")
+
+// RunQueue runs at most Workers runs at a time. Other runs wait in a FIFO
+// queue of at most Size runs.
+type RunQueue struct {
+	Workers  int
+	Size     int
+	mu       sync.Mutex
+	running  int
+	reserved int
+	waiting  []*Run
+}
+
+func NewRunQueue(workers int, size int) *RunQueue {
+	return &RunQueue{
+		Workers: workers,
+		Size:    size,
+	}
+}
+
+// reserve takes a place for a run about to be submitted, so the run is not
+// created when it could not be queued.
+func (q *RunQueue) reserve() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running+len(q.waiting)+q.reserved >= q.Workers+q.Size {
+		return ErrQueueFull
+	}
+	q.reserved++
+	return nil
+}
+
+// release gives back a place taken by reserve for a run which was not
+// created.
+func (q *RunQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reserved--
+}
+
+// submit starts the run if a worker is free, or queues it, in the place
+// taken by reserve.
+func (q *RunQueue) submit(run *Run) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reserved--
+	if q.running < q.Workers {
+		q.running++
+		go q.work(run)
+		return
+	}
+	q.waiting = append(q.waiting, run)
+}
+
+// work runs run, then the queued runs until the queue is empty.
+func (q *RunQueue) work(run *Run) {
+	for run != nil {
+		run.Hook.AsyncRun(run)
+		q.mu.Lock()
+		run = nil
+		if len(q.waiting) > 0 {
+			run = q.waiting[0]
+			q.waiting = q.waiting[1:]
+		} else {
+			q.running--
+		}
+		q.mu.Unlock()
+	}
+}
+
+// remove takes the run out of the queue and reports whether it was waiting.
+func (q *RunQueue) remove(run *Run) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, r := range q.waiting {
+		if r == run {
+			q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Position returns the 1-based position of the run in the queue, or 0 if the
+// run is not waiting.
+func (q *RunQueue) Position(run *Run) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, r := range q.waiting {
+		if r == run {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// QueuePosition returns the 1-based position of the run in the engine run
+// queue, or 0 if the run is not waiting for a worker.
+func (r *Run) QueuePosition() int {
+	if r.Hook == nil || r.Hook.HookEngine.Queue == nil {
+		return 0
+	}
+	return r.Hook.HookEngine.Queue.Position(r)
+}
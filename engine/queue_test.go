@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitStatus(t *testing.T, r *Run, status RunStatus) {
+	deadline := time.Now().Add(5 * time.Second)
+	for r.State().Status != status {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %+v, got %+v", status, r.State().Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunQueue(t *testing.T) {
+	setup()
+	e.Queue = NewRunQueue(1, 2)
+	h, err := e.ReadHook("tests/hooks", "tests", "test_cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := h.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Run(nil); err != ErrQueueFull {
+		t.Fatalf("want %+v, got %+v", ErrQueueFull, err)
+	}
+	waitStatus(t, first, RunRunning)
+	for i, r := range []*Run{second, third} {
+		outputS := r.State().Status
+		expectedS := RunQueued
+		if outputS != expectedS {
+			t.Fatalf("want %+v, got %+v", expectedS, outputS)
+		}
+		output := r.QueuePosition()
+		expected := i + 1
+		if output != expected {
+			t.Fatalf("want %+v, got %+v", expected, output)
+		}
+	}
+
+	// a cancelled queued run leaves the queue right away
+	if err := third.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, third, RunCancelled)
+	if _, err := h.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next queued run starts when the worker is free
+	if err := first.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, first, RunCancelled)
+	waitStatus(t, second, RunRunning)
+	output := second.QueuePosition()
+	expected := 0
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	if err := second.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !second.Wait(ctx) {
+		t.Fatal("run not over after cancellation")
+	}
+}
@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Misfire is the policy applied to the fire times of a schedule missed while
+// nombda was down.
+type Misfire string
+
+const (
+	// MisfireSkip forgets missed fire times.
+	MisfireSkip Misfire = "skip"
+	// MisfireRunOnce starts a single run for all the missed fire times.
+	MisfireRunOnce Misfire = "run_once"
+)
+
+// Schedule starts runs of a hook at the times of a cron expression.
+type Schedule struct {
+	// Cron has five fields: minute, hour, day of month, month and day of
+	// week, or is one of @yearly, @monthly, @weekly, @daily and @hourly.
+	Cron string `yaml:"cron"`
+	// Timezone is the IANA name of the zone of the cron expression, UTC if
+	// empty.
+	Timezone string            `yaml:"timezone"`
+	Vars     map[string]string `yaml:"vars"`
+	// Misfire is skip if empty.
+	Misfire Misfire `yaml:"misfire"`
+	cron    *cronExpr
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// cronExpr is a parsed cron expression. Each field lists the values it
+// matches.
+type cronExpr struct {
+	minute   [60]bool
+	hour     [24]bool
+	dom      [32]bool
+	month    [13]bool
+	dow      [7]bool
+	domStar  bool
+	dowStar  bool
+	location *time.Location
+}
+
+// parseCron parses a cron expression of the given zone.
+func parseCron(expr string, location *time.Location) (*cronExpr, error) {
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q must have 5 fields", expr)
+	}
+	c := &cronExpr{location: location}
+	var dow [8]bool
+	for _, f := range []struct {
+		field string
+		set   []bool
+		min   int
+		max   int
+		names []string
+	}{
+		{fields[0], c.minute[:], 0, 59, nil},
+		{fields[1], c.hour[:], 0, 23, nil},
+		{fields[2], c.dom[:], 1, 31, nil},
+		{fields[3], c.month[:], 1, 12, monthNames},
+		// 7 is sunday too
+		{fields[4], dow[:], 0, 7, dayNames},
+	} {
+		if err := parseCronField(f.field, f.set, f.min, f.max, f.names); err != nil {
+			return nil, fmt.Errorf("%q: %s", expr, err.Error())
+		}
+	}
+	copy(c.dow[:], dow[:7])
+	c.dow[0] = c.dow[0] || dow[7]
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField sets the values of a comma separated list of *, values and
+// ranges, each with an optional /step.
+func parseCronField(field string, set []bool, min int, max int, names []string) error {
+	for _, item := range strings.Split(field, ",") {
+		rangePart, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			rangePart = item[:i]
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return fmt.Errorf("invalid step in %q", item)
+			}
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = cronValue(bounds[0], min, max, names); err != nil {
+				return err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = cronValue(bounds[1], min, max, names); err != nil {
+					return err
+				}
+			} else if step > 1 {
+				// a/step means a-max/step
+				to = max
+			}
+			if from > to {
+				return fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func cronValue(s string, min int, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i + min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid value %q, want %d-%d", s, min, max)
+	}
+	return v, nil
+}
+
+func (c *cronExpr) matchDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[t.Weekday()]
+	switch {
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	default:
+		// like cron, either restricted field matches
+		return dom || dow
+	}
+}
+
+// next returns the first time matching the expression after t, or the zero
+// time if there is none within 5 years.
+func (c *cronExpr) next(t time.Time) time.Time {
+	t = t.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !c.month[m]:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, c.location)
+		case !c.matchDay(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, c.location)
+		case !c.hour[t.Hour()]:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, c.location)
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Next returns the first fire time of the schedule after t.
+func (s *Schedule) Next(t time.Time) time.Time {
+	return s.cron.next(t)
+}
+
+// validateSchedule checks the schedule entries of the hook. It must run
+// after validateParams as schedule vars are checked against the params.
+func (h *Hook) validateSchedule() error {
+	for i, s := range h.Schedule {
+		location, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("Invalid timezone %s in schedule %d: %s", s.Timezone, i, err.Error())
+		}
+		if s.cron, err = parseCron(s.Cron, location); err != nil {
+			return fmt.Errorf("Invalid cron in schedule %d: %s", i, err.Error())
+		}
+		switch s.Misfire {
+		case "", MisfireSkip, MisfireRunOnce:
+		default:
+			return fmt.Errorf("Invalid misfire %s in schedule %d", s.Misfire, i)
+		}
+		if _, err := h.CheckParams(s.Vars); err != nil {
+			return fmt.Errorf("Invalid vars in schedule %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		cron     string
+		timezone string
+		after    string
+		expected string
+	}{
+		{"*/15 * * * *", "", "2021-03-01T10:07:00Z", "2021-03-01T10:15:00Z"},
+		{"0 3 * * *", "", "2021-03-01T03:00:00Z", "2021-03-02T03:00:00Z"},
+		{"30 2 * * mon-fri", "", "2021-03-05T03:00:00Z", "2021-03-08T02:30:00Z"},
+		{"0 0 1 jan,jul *", "", "2021-03-01T00:00:00Z", "2021-07-01T00:00:00Z"},
+		{"0 12 13 * 5", "", "2021-03-01T00:00:00Z", "2021-03-05T12:00:00Z"},
+		{"0 0 * * 7", "", "2021-03-01T00:00:00Z", "2021-03-07T00:00:00Z"},
+		{"@monthly", "", "2021-03-01T00:00:00Z", "2021-04-01T00:00:00Z"},
+		{"0 0 29 2 *", "", "2021-03-01T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"0 3 * * *", "Europe/Paris", "2021-03-01T00:00:00Z", "2021-03-01T02:00:00Z"},
+		// summer time
+		{"0 3 * * *", "Europe/Paris", "2021-06-01T00:00:00Z", "2021-06-01T01:00:00Z"},
+		// 02:30 does not exist on the day summer time starts
+		{"30 2 * * *", "Europe/Paris", "2021-03-27T02:00:00Z", "2021-03-29T00:30:00Z"},
+	}
+	for _, test := range tests {
+		h := &Hook{Schedule: []*Schedule{{Cron: test.cron, Timezone: test.timezone}}}
+		if err := h.validateSchedule(); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := time.Parse(time.RFC3339, test.after)
+		expected, _ := time.Parse(time.RFC3339, test.expected)
+		output := h.Schedule[0].Next(after)
+		if !output.Equal(expected) {
+			t.Fatalf("%s: want %+v, got %+v", test.cron, expected, output.UTC())
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	setup()
+	schedules := []*Schedule{
+		{Cron: "* * * *"},
+		{Cron: "60 * * * *"},
+		{Cron: "5-1 * * * *"},
+		{Cron: "*/0 * * * *"},
+		{Cron: "0 0 * * funday"},
+		{Cron: "@often"},
+		{Cron: "0 0 * * *", Timezone: "Mars/Olympus_Mons"},
+		{Cron: "0 0 * * *", Misfire: "run_all"},
+	}
+	for _, s := range schedules {
+		h := &Hook{Schedule: []*Schedule{s}}
+		if err := h.validateSchedule(); err == nil {
+			t.Fatalf("want error for schedule %+v", s)
+		}
+	}
+	if _, err := e.ReadHook("tests/hooks", "invalid", "schedule_vars"); err == nil {
+		t.Fatal("want error for schedule vars not matching params")
+	}
+}
@@ -0,0 +1,251 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// misfireThreshold is how late a fire time can be started before it counts
+// as missed.
+const misfireThreshold = time.Minute
+
+// scheduleRescan is the longest time the scheduler waits before reading the
+// hooks again, so that schedule changes are picked up.
+const scheduleRescan = time.Minute
+
+// Clock tells the time to the scheduler.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// ScheduleEntry is a schedule of a hook action with its fire times.
+type ScheduleEntry struct {
+	Hook     string            `json:"hook"`
+	Action   string            `json:"action"`
+	Cron     string            `json:"cron"`
+	Timezone string            `json:"timezone"`
+	Misfire  Misfire           `json:"misfire"`
+	Vars     map[string]string `json:"vars"`
+	Next     time.Time         `json:"next"`
+	// CheckedAt is the last time the schedule was checked, nil before the
+	// first check.
+	CheckedAt *time.Time `json:"checked_at"`
+	key       string
+	hook      *Hook
+	schedule  *Schedule
+}
+
+// Scheduler starts the runs of the schedules of every hook of the engine.
+type Scheduler struct {
+	Engine *HookEngine
+	Clock  Clock
+	// StateFile records when each schedule was last checked, so that fire
+	// times missed while nombda was down are found on start. Missed fire
+	// times are not known if empty.
+	StateFile string
+	mu        sync.Mutex
+	last      map[string]time.Time
+}
+
+// NewScheduler returns a scheduler of the engine hooks reading its state from
+// stateFile, if not empty.
+func NewScheduler(e *HookEngine, stateFile string) (*Scheduler, error) {
+	s := &Scheduler{
+		Engine:    e,
+		Clock:     realClock{},
+		StateFile: stateFile,
+		last:      make(map[string]time.Time),
+	}
+	if stateFile == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.last); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Entries lists the schedules of every hook, with their next fire time.
+// Hooks which cannot be read are left out.
+func (s *Scheduler) Entries() ([]ScheduleEntry, error) {
+	entries, _, err := s.entries()
+	return entries, err
+}
+
+// entries lists the schedules of every hook which can be read, and the
+// hook/action of those which cannot.
+func (s *Scheduler) entries() ([]ScheduleEntry, []string, error) {
+	actions, err := s.Engine.actions()
+	if err != nil {
+		return nil, nil, err
+	}
+	var hooks []*Hook
+	var broken []string
+	for _, action := range actions {
+		h, err := s.Engine.ReadHook(s.Engine.ConfigDir, action[0], action[1])
+		if err != nil {
+			// one invalid file does not stop the schedules of the others
+			log.Errorf("Unable to read schedules of %s/%s: %s", action[0], action[1], err)
+			broken = append(broken, action[0]+"/"+action[1])
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+	now := s.Clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []ScheduleEntry{}
+	for _, h := range hooks {
+		for _, schedule := range h.Schedule {
+			misfire := schedule.Misfire
+			if misfire == "" {
+				misfire = MisfireSkip
+			}
+			timezone := schedule.Timezone
+			if timezone == "" {
+				timezone = "UTC"
+			}
+			entry := ScheduleEntry{
+				Hook:     h.Name,
+				Action:   h.Action,
+				Cron:     schedule.Cron,
+				Timezone: timezone,
+				Misfire:  misfire,
+				Vars:     schedule.Vars,
+				Next:     schedule.Next(now),
+				key:      h.Name + "/" + h.Action + " " + schedule.Cron + " " + timezone,
+				hook:     h,
+				schedule: schedule,
+			}
+			if last, ok := s.last[entry.key]; ok {
+				entry.CheckedAt = &last
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Next.Before(entries[j].Next)
+	})
+	return entries, broken, nil
+}
+
+// Run starts the runs of the schedules until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := s.Clock.Now()
+		wait := scheduleRescan
+		if next := s.tick(now); !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Clock.After(wait):
+		}
+	}
+}
+
+// tick starts the runs of the schedules which fired since they were last
+// checked and returns the next fire time of all schedules.
+func (s *Scheduler) tick(now time.Time) time.Time {
+	entries, broken, err := s.entries()
+	if err != nil {
+		log.Errorf("Unable to read hooks of schedules: %s", err)
+		return time.Time{}
+	}
+	var next time.Time
+	// schedules removed from the hooks are forgotten, those of hooks which
+	// cannot be read are checked again once fixed and fire times missed
+	// meanwhile follow their misfire policy
+	last := make(map[string]time.Time)
+	s.mu.Lock()
+	for key, checkedAt := range s.last {
+		for _, action := range broken {
+			if strings.HasPrefix(key, action+" ") {
+				last[key] = checkedAt
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, entry := range entries {
+		if entry.CheckedAt != nil && s.due(entry, *entry.CheckedAt, now) {
+			s.fire(entry)
+		}
+		last[entry.key] = now
+		if n := entry.schedule.Next(now); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+	s.mu.Lock()
+	s.last = last
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		log.Errorf("Unable to save schedules state: %s", err)
+	}
+	return next
+}
+
+// due reports whether the schedule must start a run at now, given it was
+// last checked at last.
+func (s *Scheduler) due(entry ScheduleEntry, last time.Time, now time.Time) bool {
+	if first := entry.schedule.Next(last); first.IsZero() || first.After(now) {
+		return false
+	}
+	// a fire time within the threshold is on time
+	if onTime := entry.schedule.Next(now.Add(-misfireThreshold)); !onTime.IsZero() && !onTime.After(now) {
+		return true
+	}
+	if entry.Misfire == MisfireRunOnce {
+		log.Infof("Running schedule %s of %s/%s missed since %s", entry.Cron, entry.Hook, entry.Action, last.Format(time.RFC3339))
+		return true
+	}
+	log.Warnf("Skipping schedule %s of %s/%s missed since %s", entry.Cron, entry.Hook, entry.Action, last.Format(time.RFC3339))
+	return false
+}
+
+func (s *Scheduler) fire(entry ScheduleEntry) {
+	run, err := entry.hook.RunTrigger(Trigger{Vars: entry.Vars, Token: "schedule"})
+	if err != nil {
+		log.Errorf("Unable to run schedule %s of %s/%s: %s", entry.Cron, entry.Hook, entry.Action, err)
+		return
+	}
+	log.Infof("Schedule %s of %s/%s started job %s", entry.Cron, entry.Hook, entry.Action, run.ID)
+}
+
+// save writes the state file, if any.
+func (s *Scheduler) save() error {
+	if s.StateFile == "" {
+		return nil
+	}
+	s.mu.Lock()
+	data, err := json.Marshal(s.last)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.StateFile, data)
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves with Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	// waiting receives a value each time After is called.
+	waiting chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waiting: make(chan struct{}, 10)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.waiting <- struct{}{}
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var timers []fakeTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+			continue
+		}
+		timer.c <- c.now
+	}
+	c.timers = timers
+}
+
+// newTestScheduler returns a scheduler of a config dir holding a hook
+// scheduled every hour, recording its runs in an audit log.
+func newTestScheduler(t *testing.T, misfire Misfire, now time.Time) (*Scheduler, *AuditLog) {
+	dir := tempDir(t)
+	if err := os.Mkdir(dir+"/cleanup", 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := "schedule:\n  - cron: \"0 * * * *\"\n    misfire: " + string(misfire) + "\n    vars:\n      target: tmp\ntasks:\n  - command: echo ${var.target}\n"
+	if err := ioutil.WriteFile(dir+"/cleanup/nightly.yml", []byte(hook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewHookEngine(dir, nil)
+	audit, err := NewAuditLog(dir+"/audit.jsonl", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Audit = audit
+	s, err := NewScheduler(e, dir+"/schedules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Clock = newFakeClock(now)
+	return s, audit
+}
+
+func triggeredRuns(t *testing.T, audit *AuditLog) []AuditEntry {
+	entries, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var triggered []AuditEntry
+	for _, entry := range entries {
+		if entry.Type == AuditRunTriggered {
+			triggered = append(triggered, entry)
+		}
+	}
+	return triggered
+}
+
+func TestSchedulerRun(t *testing.T) {
+	now := time.Date(2021, 3, 1, 9, 59, 30, 0, time.UTC)
+	s, audit := newTestScheduler(t, MisfireSkip, now)
+	clock := s.Clock.(*fakeClock)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	<-clock.waiting
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := entries[0].Next
+	expected := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	if len(entries) != 1 || !output.Equal(expected) {
+		t.Fatalf("want %+v, got %+v", expected, entries)
+	}
+	if runs := triggeredRuns(t, audit); len(runs) != 0 {
+		t.Fatalf("want no run before the fire time, got %+v", runs)
+	}
+
+	clock.Advance(30 * time.Second)
+	<-clock.waiting
+	runs := triggeredRuns(t, audit)
+	if len(runs) != 1 {
+		t.Fatalf("want 1 run, got %+v", runs)
+	}
+	outputE := runs[0]
+	expectedE := AuditEntry{Type: AuditRunTriggered, Token: "schedule", Hook: "cleanup", Action: "nightly", Params: map[string]string{"target": "tmp"}, RunID: outputE.RunID, Outcome: RunQueued}
+	outputE.Time = time.Time{}
+	if !reflect.DeepEqual(outputE, expectedE) {
+		t.Fatalf("want %+v, got %+v", expectedE, outputE)
+	}
+
+	// the next check is at the rescan interval
+	clock.Advance(time.Minute)
+	<-clock.waiting
+	if runs := triggeredRuns(t, audit); len(runs) != 1 {
+		t.Fatalf("want 1 run, got %+v", runs)
+	}
+}
+
+func TestSchedulerMisfire(t *testing.T) {
+	down := time.Date(2021, 3, 1, 7, 30, 0, 0, time.UTC)
+	up := time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		misfire  Misfire
+		expected int
+	}{
+		{MisfireSkip, 0},
+		{MisfireRunOnce, 1},
+	}
+	for _, test := range tests {
+		s, audit := newTestScheduler(t, test.misfire, down)
+		s.tick(down)
+		// restart after missing 3 fire times
+		s, err := NewScheduler(s.Engine, s.StateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Clock = newFakeClock(up)
+		s.tick(up)
+		output := len(triggeredRuns(t, audit))
+		if output != test.expected {
+			t.Fatalf("%s: want %+v, got %+v", test.misfire, test.expected, output)
+		}
+		entries, err := s.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries[0].CheckedAt == nil || !entries[0].CheckedAt.Equal(up) {
+			t.Fatalf("want %+v, got %+v", up, entries[0].CheckedAt)
+		}
+	}
+}
+
+func TestSchedulerInvalidHook(t *testing.T) {
+	now := time.Date(2021, 3, 1, 9, 59, 30, 0, time.UTC)
+	s, audit := newTestScheduler(t, MisfireSkip, now)
+	dir := s.Engine.ConfigDir
+	if err := os.Mkdir(dir+"/broken", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/broken/renew.yml", []byte("tasks: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	brokenKey := "broken/renew 0 * * * * UTC"
+	s.last[brokenKey] = now.Add(-time.Hour)
+	s.tick(now)
+	s.tick(now.Add(30 * time.Second))
+	if runs := triggeredRuns(t, audit); len(runs) != 1 {
+		t.Fatalf("want 1 run, got %+v", runs)
+	}
+	// the state of the invalid hook is kept until it is fixed
+	output, ok := s.last[brokenKey]
+	expected := now.Add(-time.Hour)
+	if !ok || !output.Equal(expected) {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("want 1 entry, got %+v", entries)
+	}
+}
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrRunNotFound is returned by a RunStore when no run has the requested id.
+var ErrRunNotFound = errors.New("run id not found")
+
+// RunStore keeps track of runs so they can be looked up by id.
+type RunStore interface {
+	Save(run *Run) error
+	Get(id string) (*Run, error)
+}
+
+// MemoryRunStore keeps runs in memory. Runs are lost when the process exits.
+type MemoryRunStore struct {
+	mu   sync.Mutex
+	runs map[string]*Run
+}
+
+func NewMemoryRunStore() *MemoryRunStore {
+	return &MemoryRunStore{
+		runs: make(map[string]*Run),
+	}
+}
+
+func (s *MemoryRunStore) Save(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[run.ID] = run
+	return nil
+}
+
+// remove forgets the run with the given id.
+func (s *MemoryRunStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runs, id)
+}
+
+func (s *MemoryRunStore) Get(id string) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run, ok := s.runs[id]
+	if !ok {
+		return nil, ErrRunNotFound
+	}
+	return run, nil
+}
+
+// FileRunStore saves each run as a JSON file in a directory so runs survive
+// restarts. Runs in progress are also kept in memory, finished runs are read
+// back from their file.
+type FileRunStore struct {
+	Dir    string
+	memory *MemoryRunStore
+}
+
+// NewFileRunStore opens the run directory, creating it if needed. Runs left
+// queued or running by a previous process are marked as interrupted.
+func NewFileRunStore(dir string) (*FileRunStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &FileRunStore{
+		Dir:    dir,
+		memory: NewMemoryRunStore(),
+	}
+	if err := s.interruptRuns(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileRunStore) filename(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+func (s *FileRunStore) Save(run *Run) error {
+	state := run.State()
+	data, err := json.Marshal(struct {
+		RunState
+		Output *LogBuffer `json:"output"`
+	}{state, run.Output})
+	if err != nil {
+		return err
+	}
+	if !state.Status.Terminal() {
+		if err := s.memory.Save(run); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(s.filename(run.ID), data); err != nil {
+		return err
+	}
+	if state.Status.Terminal() {
+		s.memory.remove(run.ID)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to filename through a temporary file renamed
+// over it, so a crash never leaves a truncated file.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func (s *FileRunStore) Get(id string) (*Run, error) {
+	if run, err := s.memory.Get(id); err == nil {
+		return run, nil
+	}
+	if filepath.Base(id) != id {
+		return nil, ErrRunNotFound
+	}
+	run, err := s.read(s.filename(id))
+	if os.IsNotExist(err) {
+		return nil, ErrRunNotFound
+	}
+	return run, err
+}
+
+func (s *FileRunStore) read(filename string) (*Run, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	run := &Run{}
+	if err := json.Unmarshal(data, run); err != nil {
+		return nil, fmt.Errorf("Unable to read run file %s: %s", filename, err.Error())
+	}
+	if run.Output == nil {
+		run.Output = &LogBuffer{}
+	}
+	if run.Status.Terminal() {
+		run.Output.Close()
+	}
+	return run, nil
+}
+
+func (s *FileRunStore) interruptRuns() error {
+	filenames, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		run, err := s.read(filename)
+		if err != nil {
+			return err
+		}
+		if run.Status.Terminal() {
+			continue
+		}
+		finishedAt := time.Now()
+		run.FinishedAt = &finishedAt
+		run.Status = RunInterrupted
+		run.logError(fmt.Sprintf("Job %s interrupted by a nombda restart", run.ID))
+		run.Output.Close()
+		if err := s.Save(run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFileRunStore(t *testing.T) {
+	dir := tempDir(t)
+	store, err := NewFileRunStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewHookEngine("", store)
+	h, err := e.ReadHook("tests/hooks", "tests", "test_register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AsyncRun(r)
+
+	store, err = NewFileRunStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Get(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputS := saved.Status
+	expectedS := RunSucceeded
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	output := saved.Registers["bar"]
+	expected := "foo"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = saved.Log()
+	expected = r.Log()
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = saved.HookName + "/" + saved.Action
+	expected = "tests/test_register"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+
+	if _, err := store.Get("unknown"); err != ErrRunNotFound {
+		t.Fatalf("want %+v, got %+v", ErrRunNotFound, err)
+	}
+}
+
+func TestFileRunStoreInterrupted(t *testing.T) {
+	dir := tempDir(t)
+	store, err := NewFileRunStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewHookEngine("", store)
+	h, err := e.ReadHook("tests/hooks", "tests", "test_register")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileRunStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Get(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputS := saved.Status
+	expectedS := RunInterrupted
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+	if saved.FinishedAt == nil {
+		t.Fatal("want finish timestamp on interrupted run")
+	}
+}
+
+func TestFileRunStoreSecrets(t *testing.T) {
+	dir := tempDir(t)
+	store, err := NewFileRunStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewHookEngine("", store)
+	e.Secrets["foo"] = "s3cr3t"
+	h, err := e.ReadHook("tests/hooks", "tests", "test_command_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRun(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Vars = map[string]string{"password": "s3cr3t"}
+	h.AsyncRun(r)
+	// the run keeps the value for later tasks
+	output := r.Registers["foo"]
+	expected := "secret:s3cr3t"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	data, err := ioutil.ReadFile(store.filename(r.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cr3t") {
+		t.Fatalf("want secret masked in run file, got %s", data)
+	}
+
+	// finished runs are read back from their file
+	if _, err := store.memory.Get(r.ID); err != ErrRunNotFound {
+		t.Fatalf("want %+v, got %+v", ErrRunNotFound, err)
+	}
+	saved, err := store.Get(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output = saved.Registers["foo"]
+	expected = "secret:***"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestMemoryRunStore(t *testing.T) {
+	store := NewMemoryRunStore()
+	if _, err := store.Get("unknown"); err != ErrRunNotFound {
+		t.Fatalf("want %+v, got %+v", ErrRunNotFound, err)
+	}
+	r := &Run{RunState: RunState{ID: "foo"}}
+	if err := store.Save(r); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != r {
+		t.Fatalf("want %+v, got %+v", r, saved)
+	}
+}
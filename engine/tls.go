@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// CertReloader serves a certificate and key pair, reloading it when the
+// files change so certificates can be renewed without a restart.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	version  string
+}
+
+// NewCertReloader loads the certificate and key pair.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileVersion identifies the content of the files by their modification
+// time and size.
+func fileVersion(filenames ...string) (string, error) {
+	version := ""
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		version += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
+
+// reload loads the pair if the files changed since the last load.
+func (r *CertReloader) reload() error {
+	version, err := fileVersion(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	if version == r.version {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load certificate %s: %s", r.CertFile, err.Error())
+	}
+	r.cert = &cert
+	r.version = version
+	return nil
+}
+
+// GetCertificate is meant for tls.Config. If the files changed but cannot be
+// loaded, e.g. while they are being replaced, the previous pair is served.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		log.Errorf("Unable to reload TLS certificate, serving the previous one: %s", err)
+	}
+	return r.cert, nil
+}
+
+// TLSConfig returns the server TLS configuration serving certFile and
+// keyFile. If clientCAFile is set, client certificates are verified against
+// it, and required if requireClientCert is true.
+func TLSConfig(certFile string, keyFile string, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile == "" {
+		if requireClientCert {
+			return nil, fmt.Errorf("A client CA is needed to require client certificates")
+		}
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificate found in client CA file %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
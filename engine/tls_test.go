@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates a certificate signed by parent, or a self-signed CA
+// if parent is nil.
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"nombda"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, dir string, name string, modTime time.Time) {
+	for filename, data := range map[string][]byte{dir + "/" + name + ".crt": c.certPEM, dir + "/" + name + ".key": c.keyPEM} {
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", 1, nil)
+	now := time.Now()
+	newTestCert(t, "server", 2, ca).write(t, dir, "server", now)
+	r, err := NewCertReloader(dir+"/server.crt", dir+"/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	output := leaf.SerialNumber.Int64()
+	expected := int64(2)
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+
+	newTestCert(t, "server", 3, ca).write(t, dir, "server", now.Add(time.Second))
+	cert, _ = r.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	output = leaf.SerialNumber.Int64()
+	expected = int64(3)
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+
+	// an invalid pair keeps the previous one
+	if err := ioutil.WriteFile(dir+"/server.key", []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = r.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	output = leaf.SerialNumber.Int64()
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCert(t, "ca", 1, nil)
+	if err := ioutil.WriteFile(dir+"/ca.crt", ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	newTestCert(t, "server", 2, ca).write(t, dir, "server", time.Now())
+	client := newTestCert(t, "ci", 3, ca)
+	config, err := TLSConfig(dir+"/server.crt", dir+"/server.key", dir+"/ca.crt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := &TokenRegistry{}
+	if err := tokens.Add(&Token{Name: "ci", ClientSubject: "CN=ci,O=nombda", Scopes: []Scope{ScopeTrigger}}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := tokens.LookupClientCert(req.TLS)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(token.Name))
+	}))
+	// StartTLS would serve its own certificate, serve config instead
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	defer server.Close()
+	url := "https://" + server.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientPair, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		certificates []tls.Certificate
+		expected     int
+	}{
+		{[]tls.Certificate{clientPair}, http.StatusOK},
+		{nil, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: test.certificates}}}
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Fatalf("want %+v, got %+v", test.expected, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK && string(body) != "ci" {
+			t.Fatalf("want %+v, got %+v", "ci", string(body))
+		}
+	}
+
+	// a certificate from another CA is rejected
+	other := newTestCert(t, "ci", 4, newTestCert(t, "other ca", 5, nil))
+	otherPair, _ := tls.X509KeyPair(other.certPEM, other.keyPEM)
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots,
+		// send it even though the server does not accept its CA
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &otherPair, nil
+		},
+	}}}
+	if resp, err := c.Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("want handshake error for certificate from another CA")
+	}
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Scope is a permission given to an API token.
+type Scope string
+
+const (
+	// ScopeList allows listing hooks.
+	ScopeList Scope = "list"
+	// ScopeTrigger allows triggering runs.
+	ScopeTrigger Scope = "trigger"
+	// ScopeReadLogs allows reading runs, their steps and their log.
+	ScopeReadLogs Scope = "read-logs"
+	// ScopeCancel allows cancelling runs.
+	ScopeCancel Scope = "cancel"
+	// ScopeAdmin allows everything.
+	ScopeAdmin Scope = "admin"
+)
+
+// Token is an API token allowed to call the endpoints of its scopes on the
+// hooks matching its patterns.
+type Token struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	// ClientSubject is the subject of the TLS client certificates
+	// authenticated as this token, e.g. CN=ci,O=Example.
+	ClientSubject string  `yaml:"client_subject"`
+	Scopes        []Scope `yaml:"scopes"`
+	// Hooks lists hook/action glob patterns, e.g. mywebsite/*. A pattern
+	// without action matches every action of the hook. Every hook matches
+	// if empty.
+	Hooks []string `yaml:"hooks"`
+}
+
+func (t *Token) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("Missing token name")
+	}
+	if t.Token == "" && t.ClientSubject == "" {
+		return fmt.Errorf("Missing token or client_subject for %s", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return fmt.Errorf("Missing scopes for token %s", t.Name)
+	}
+	for _, scope := range t.Scopes {
+		switch scope {
+		case ScopeList, ScopeTrigger, ScopeReadLogs, ScopeCancel, ScopeAdmin:
+		default:
+			return fmt.Errorf("Invalid scope %s for token %s", scope, t.Name)
+		}
+	}
+	for _, pattern := range t.Hooks {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid hook pattern %s for token %s", pattern, t.Name)
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether the token has scope, or the admin scope.
+func (t *Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHook reports whether the token patterns match the hook action.
+func (t *Token) MatchHook(hook string, action string) bool {
+	if len(t.Hooks) == 0 {
+		return true
+	}
+	for _, pattern := range t.Hooks {
+		if !strings.Contains(pattern, "/") {
+			pattern += "/*"
+		}
+		if ok, _ := path.Match(pattern, hook+"/"+action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the token can use scope on the hook action.
+func (t *Token) Allows(scope Scope, hook string, action string) bool {
+	return t.HasScope(scope) && t.MatchHook(hook, action)
+}
+
+// TokenRegistry holds the API tokens.
+type TokenRegistry struct {
+	Tokens []*Token `yaml:"tokens"`
+}
+
+// ReadTokenFile reads a token registry from a yaml file.
+func ReadTokenFile(filename string) (*TokenRegistry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &TokenRegistry{}
+	if err := yaml.UnmarshalStrict(data, r); err != nil {
+		return nil, fmt.Errorf("Unable to validate yaml file %s: %s", filename, err.Error())
+	}
+	tokens := r.Tokens
+	r.Tokens = nil
+	for _, t := range tokens {
+		if err := r.Add(t); err != nil {
+			return nil, fmt.Errorf("Invalid token file %s: %s", filename, err.Error())
+		}
+	}
+	return r, nil
+}
+
+// Add registers a token. Token names and values must be unique.
+func (r *TokenRegistry) Add(t *Token) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	for _, other := range r.Tokens {
+		if other.Name == t.Name {
+			return fmt.Errorf("Duplicate token name %s", t.Name)
+		}
+		if t.Token != "" && other.Token == t.Token {
+			return fmt.Errorf("Token %s has the same value as token %s", t.Name, other.Name)
+		}
+		if t.ClientSubject != "" && other.ClientSubject == t.ClientSubject {
+			return fmt.Errorf("Token %s has the same client_subject as token %s", t.Name, other.Name)
+		}
+	}
+	r.Tokens = append(r.Tokens, t)
+	return nil
+}
+
+// Lookup returns the token with the given value.
+func (r *TokenRegistry) Lookup(value string) (*Token, bool) {
+	if value == "" {
+		return nil, false
+	}
+	var found *Token
+	// compare with every token so the time taken does not tell which
+	// token is closest
+	for _, t := range r.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(value)) == 1 {
+			found = t
+		}
+	}
+	return found, found != nil
+}
+
+// LookupClientCert returns the token of the verified client certificate of
+// a TLS connection, if any.
+func (r *TokenRegistry) LookupClientCert(state *tls.ConnectionState) (*Token, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil, false
+	}
+	subject := state.VerifiedChains[0][0].Subject.String()
+	for _, t := range r.Tokens {
+		if t.ClientSubject != "" && t.ClientSubject == subject {
+			return t, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,62 @@
+package engine
+
+import "testing"
+
+func TestReadTokenFile(t *testing.T) {
+	tokens, err := ReadTokenFile("tests/tokens/tokens.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := tokens.Lookup("ci-token")
+	if !ok {
+		t.Fatal("want ci-token to be found")
+	}
+	output := token.Name
+	expected := "ci"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	if _, ok := tokens.Lookup("unknown"); ok {
+		t.Fatal("want unknown token not to be found")
+	}
+	if _, ok := tokens.Lookup(""); ok {
+		t.Fatal("want empty token not to be found")
+	}
+	for _, filename := range []string{"duplicate", "scope"} {
+		if _, err := ReadTokenFile("tests/tokens/" + filename + ".yml"); err == nil {
+			t.Fatalf("want error for tests/tokens/%s.yml", filename)
+		}
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	tokens, err := ReadTokenFile("tests/tokens/tokens.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token    string
+		scope    Scope
+		hook     string
+		action   string
+		expected bool
+	}{
+		{"ci-token", ScopeTrigger, "mywebsite", "git_update", true},
+		{"ci-token", ScopeReadLogs, "mywebsite", "git_update", true},
+		{"ci-token", ScopeTrigger, "database", "drop", false},
+		{"ci-token", ScopeCancel, "mywebsite", "git_update", false},
+		{"ops-token", ScopeCancel, "mywebsite", "git_update", true},
+		{"ops-token", ScopeCancel, "database", "backup", true},
+		{"ops-token", ScopeCancel, "database", "drop", false},
+		{"ops-token", ScopeTrigger, "database", "backup", false},
+		{"root-token", ScopeTrigger, "database", "drop", true},
+		{"root-token", ScopeCancel, "mywebsite", "git_update", true},
+	}
+	for _, test := range tests {
+		token, _ := tokens.Lookup(test.token)
+		output := token.Allows(test.scope, test.hook, test.action)
+		if output != test.expected {
+			t.Fatalf("%s %s %s/%s: want %+v, got %+v", test.token, test.scope, test.hook, test.action, test.expected, output)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// traceparentRegexp matches a W3C traceparent header of version 00.
+var traceparentRegexp = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// ParseTraceparent reads a W3C traceparent header. Invalid headers, including
+// all-zero ids, are reported as not ok.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	m := traceparentRegexp.FindStringSubmatch(header)
+	if m == nil || m[1] == "00000000000000000000000000000000" || m[2] == "0000000000000000" {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: m[1], SpanID: m[2]}, true
+}
+
+// Traceparent returns the W3C traceparent header of the span, sampled.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// Span is a timed operation of a run: the run itself, a task, a handler or
+// a command attempt.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	// Attributes values are strings, ints or bools.
+	Attributes map[string]interface{}
+	// Error is the status message of failed spans.
+	Error string
+}
+
+// SpanExporter sends the spans of a finished run to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(spans []Span) error
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func (r *Run) tracing() bool {
+	return r.Hook != nil && r.Hook.HookEngine.SpanExporter != nil
+}
+
+// startSpan opens a span, child of the innermost open span of the run.
+func (r *Run) startSpan(name string, attributes map[string]interface{}) {
+	if !r.tracing() {
+		return
+	}
+	r.update(func() {
+		span := &Span{
+			TraceID:    r.TraceID,
+			SpanID:     randomID(8),
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: attributes,
+		}
+		if span.Attributes == nil {
+			span.Attributes = make(map[string]interface{})
+		}
+		if len(r.spans) > 0 {
+			span.ParentSpanID = r.spans[len(r.spans)-1].SpanID
+		} else {
+			span.ParentSpanID = r.parentSpanID
+		}
+		r.spans = append(r.spans, span)
+	})
+}
+
+// setSpanAttribute sets an attribute of the innermost open span.
+func (r *Run) setSpanAttribute(key string, value interface{}) {
+	if !r.tracing() {
+		return
+	}
+	r.update(func() {
+		if len(r.spans) > 0 {
+			r.spans[len(r.spans)-1].Attributes[key] = value
+		}
+	})
+}
+
+// endSpan closes the innermost open span, failed if err is not nil.
+func (r *Run) endSpan(err error) {
+	if !r.tracing() {
+		return
+	}
+	r.update(func() {
+		if len(r.spans) == 0 {
+			return
+		}
+		span := r.spans[len(r.spans)-1]
+		r.spans = r.spans[:len(r.spans)-1]
+		span.End = time.Now()
+		if err != nil {
+			span.Error = r.hideSecrets(err.Error())
+		}
+		r.finishedSpans = append(r.finishedSpans, *span)
+	})
+}
+
+// exportSpans sends the spans of the run in the background.
+func (r *Run) exportSpans() {
+	if !r.tracing() {
+		return
+	}
+	var spans []Span
+	r.update(func() {
+		spans = r.finishedSpans
+		r.finishedSpans = nil
+	})
+	exporter := r.Hook.HookEngine.SpanExporter
+	go func() {
+		if err := exporter.ExportSpans(spans); err != nil {
+			log.Errorf("Unable to export spans of run %s: %s", r.ID, err)
+		}
+	}()
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with the OTLP/HTTP
+// JSON encoding.
+type OTLPExporter struct {
+	// Endpoint is the traces URL, e.g. http://localhost:4318/v1/traces.
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := []otlpAttribute{}
+	for _, k := range keys {
+		var value otlpValue
+		switch v := attributes[k].(type) {
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		result = append(result, otlpAttribute{Key: k, Value: value})
+	}
+	return result
+}
+
+func (e *OTLPExporter) ExportSpans(spans []Span) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			otlpSpans[i].Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+	}
+	serviceName := e.ServiceName
+	if serviceName == "" {
+		serviceName = "nombda"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "nombda"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type memoryExporter struct {
+	exported chan []Span
+}
+
+func (e *memoryExporter) ExportSpans(spans []Span) error {
+	e.exported <- spans
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("want valid traceparent")
+	}
+	output := sc.Traceparent()
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	for _, header := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(header); ok {
+			t.Fatalf("want invalid traceparent %s", header)
+		}
+	}
+}
+
+func TestHookTrace(t *testing.T) {
+	setup()
+	exporter := &memoryExporter{exported: make(chan []Span, 1)}
+	e.SpanExporter = exporter
+	h, err := e.ReadHook("tests/hooks", "tests", "test_trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.GlobalVars = map[string]string{"dir": tempDir(t)}
+	r, err := h.RunTrigger(Trigger{Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Wait(context.Background())
+	var spans []Span
+	select {
+	case spans = <-exporter.exported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spans not exported")
+	}
+	names := make(map[string]Span)
+	byID := make(map[string]Span)
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("want trace of the caller, got %+v", s.TraceID)
+		}
+		byID[s.SpanID] = s
+		key := s.Name
+		if s.Name == "command" {
+			key = fmt.Sprintf("command %d", s.Attributes["nombda.attempt"])
+		}
+		names[key] = s
+	}
+	// every span but the run one is a child of the span listed after it
+	for _, path := range [][]string{
+		{"command 1", "task flaky deploy", "handler deploy", "task deploy", "run tests/test_trace"},
+		{"command 2", "task flaky deploy", "handler deploy", "task deploy", "run tests/test_trace"},
+		{"only_if", "task skipped", "run tests/test_trace"},
+	} {
+		for i, name := range path {
+			s, ok := names[name]
+			if !ok {
+				t.Fatalf("want span %s, got %+v", name, spans)
+			}
+			if i == len(path)-1 {
+				if s.ParentSpanID != "00f067aa0ba902b7" {
+					t.Fatalf("want run span child of the caller span, got %+v", s.ParentSpanID)
+				}
+				continue
+			}
+			if parent := byID[s.ParentSpanID]; parent.Name != names[path[i+1]].Name {
+				t.Fatalf("want %s parent of %s, got %+v", path[i+1], name, parent.Name)
+			}
+		}
+	}
+	if names["command 1"].Error == "" || names["command 2"].Error != "" {
+		t.Fatalf("want first attempt failed and second succeeded, got %+v %+v", names["command 1"], names["command 2"])
+	}
+	output := names["task skipped"].Attributes["nombda.skip_reason"]
+	expected := "only_if exited with code 1"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	output = names["run tests/test_trace"].Attributes["nombda.status"]
+	expected = string(RunSucceeded)
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	if r.State().TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("want run trace id, got %+v", r.State().TraceID)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		received <- payload
+	}))
+	defer server.Close()
+	exporter := &OTLPExporter{Endpoint: server.URL + "/v1/traces"}
+	start := time.Unix(1, 0)
+	err := exporter.ExportSpans([]Span{{
+		TraceID:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:     "00f067aa0ba902b7",
+		Name:       "command",
+		Start:      start,
+		End:        start.Add(time.Second),
+		Attributes: map[string]interface{}{"nombda.attempt": 1, "nombda.skipped": false, "nombda.task": "deploy"},
+		Error:      "exit status 1",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := <-received
+	span := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	data, _ := json.Marshal(span)
+	output := string(data)
+	expected := `{"attributes":[{"key":"nombda.attempt","value":{"intValue":"1"}},{"key":"nombda.skipped","value":{"boolValue":false}},{"key":"nombda.task","value":{"stringValue":"deploy"}}],"endTimeUnixNano":"2000000000","kind":1,"name":"command","spanId":"00f067aa0ba902b7","startTimeUnixNano":"1000000000","status":{"code":2,"message":"exit status 1"},"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"}`
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
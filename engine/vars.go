@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// varNameRegexp matches names usable as environment variables, which is how
+// commands read vars given by the caller.
+var varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedVarNames are environment variables changing how the shell or the
+// processes of commands behave, which callers must not set.
+var reservedVarNames = map[string]bool{
+	"PATH":             true,
+	"IFS":              true,
+	"HOME":             true,
+	"SHELL":            true,
+	"ENV":              true,
+	"BASH_ENV":         true,
+	"CDPATH":           true,
+	"SHELLOPTS":        true,
+	"BASHOPTS":         true,
+	"PS4":              true,
+	"PROMPT_COMMAND":   true,
+	"GLOBIGNORE":       true,
+	"TMPDIR":           true,
+	"GCONV_PATH":       true,
+	"HOSTALIASES":      true,
+	"NLSPATH":          true,
+	"MALLOC_CHECK_":    true,
+	"LOCPATH":          true,
+	"RESOLV_HOST_CONF": true,
+}
+
+// reservedVar reports whether name is a reserved environment variable, or
+// one of the LD_ or DYLD_ variables of the dynamic linker. Like environment
+// variables, names are case sensitive.
+func reservedVar(name string) bool {
+	return reservedVarNames[name] || strings.HasPrefix(name, "LD_") || strings.HasPrefix(name, "DYLD_")
+}
+
+// DecodeVars decodes a JSON object into vars. Numbers and booleans are
+// converted to strings, other values are kept as JSON.
+func DecodeVars(data []byte) (map[string]string, error) {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Unable to decode vars: %s", err.Error())
+	}
+	vars := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(v))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		switch value := value.(type) {
+		case string:
+			vars[k] = value
+		case json.Number:
+			vars[k] = value.String()
+		case bool:
+			vars[k] = strconv.FormatBool(value)
+		case nil:
+			vars[k] = ""
+		default:
+			vars[k] = string(v)
+		}
+	}
+	return vars, nil
+}
+
+// checkVars rejects vars given by the caller which cannot be used as
+// environment variables, which would change how commands run or which would
+// override a secret.
+func (h *Hook) checkVars(vars map[string]string) error {
+	for k := range vars {
+		if !varNameRegexp.MatchString(k) {
+			return fmt.Errorf("Invalid var name %s", k)
+		}
+		if reservedVar(k) {
+			return fmt.Errorf("Var %s is a reserved environment variable", k)
+		}
+		if _, ok := h.HookEngine.Secrets[k]; ok {
+			return fmt.Errorf("Var %s conflicts with a secret", k)
+		}
+	}
+	return nil
+}
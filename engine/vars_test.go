@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestDecodeVars(t *testing.T) {
+	vars, err := DecodeVars([]byte(`{"tag": "v1", "replicas": 3, "debug": true, "none": null, "list": [1,2]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"tag":      "v1",
+		"replicas": "3",
+		"debug":    "true",
+		"none":     "",
+		"list":     "[1,2]",
+	}
+	for k, v := range expected {
+		if vars[k] != v {
+			t.Fatalf("want %+v for %s, got %+v", v, k, vars[k])
+		}
+	}
+
+	if _, err := DecodeVars([]byte(`["tag"]`)); err == nil {
+		t.Fatal("want error for a JSON array")
+	}
+}
+
+func TestCheckVars(t *testing.T) {
+	setup()
+	e.Secrets["token"] = "123"
+	h, err := e.ReadHook("tests/hooks", "tests", "test_trigger_vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.checkVars(map[string]string{"image_tag": "v1", "_x1": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.checkVars(map[string]string{"image-tag": "v1"}); err == nil {
+		t.Fatal("want error for a var name which is not an environment variable name")
+	}
+	if err := h.checkVars(map[string]string{"token": "456"}); err == nil {
+		t.Fatal("want error for a var overriding a secret")
+	}
+	if _, err := h.Run(map[string]string{"token": "456"}); err == nil {
+		t.Fatal("want error for a var overriding a secret")
+	}
+	for _, name := range []string{"PATH", "IFS", "HOME", "SHELL", "ENV", "BASH_ENV", "LD_PRELOAD", "LD_LIBRARY_PATH", "DYLD_INSERT_LIBRARIES"} {
+		if _, err := h.Run(map[string]string{name: "/nonexistent"}); err == nil {
+			t.Fatalf("want error for reserved var %s", name)
+		}
+	}
+	if err := h.checkVars(map[string]string{"env": "prod", "path": "/srv"}); err != nil {
+		t.Fatal(err)
+	}
+}
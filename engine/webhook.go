@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrWebhookSignature is returned when a webhook delivery is not signed
+	// with the hook webhook secret.
+	ErrWebhookSignature = errors.New("Invalid webhook signature")
+
+	// ErrWebhookIgnored is returned when a webhook delivery is filtered out
+	// by the hook webhook events or branches.
+	ErrWebhookIgnored = errors.New("Webhook delivery ignored")
+)
+
+// Webhook lets a git provider trigger the hook with its own authentication:
+// deliveries are checked against a secret instead of the nombda token.
+type Webhook struct {
+	// Provider is one of github, gitlab or gitea.
+	Provider string `yaml:"provider"`
+	// Secret names the nombda secret shared with the provider.
+	Secret string `yaml:"secret"`
+	// Events lists the event types triggering a run, e.g. push. Any event
+	// triggers a run if empty.
+	Events []string `yaml:"events"`
+	// Branches lists the branch patterns triggering a run, e.g. release/*.
+	// Any delivery triggers a run if empty.
+	Branches []string `yaml:"branches"`
+	// Vars maps run vars to dotted paths in the event payload, e.g.
+	// repository.full_name.
+	Vars map[string]string `yaml:"vars"`
+}
+
+// validateWebhook checks the webhook block of the hook.
+func (h *Hook) validateWebhook() error {
+	w := h.Webhook
+	if w == nil {
+		return nil
+	}
+	switch w.Provider {
+	case "github", "gitlab", "gitea":
+	default:
+		return fmt.Errorf("Invalid webhook provider %s", w.Provider)
+	}
+	if w.Secret == "" {
+		return fmt.Errorf("Missing webhook secret")
+	}
+	for _, pattern := range w.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid webhook branch pattern %s", pattern)
+		}
+	}
+	for name := range w.Vars {
+		if !varNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid webhook var name %s", name)
+		}
+	}
+	return nil
+}
+
+// WebhookTrigger checks a delivery of provider and returns the trigger it
+// maps to. The error is ErrWebhookSignature if the delivery is not
+// authenticated, including when the hook has no webhook of provider, and
+// wraps ErrWebhookIgnored if it is filtered out.
+func (h *Hook) WebhookTrigger(provider string, header http.Header, body []byte) (Trigger, error) {
+	w := h.Webhook
+	if w == nil || w.Provider != provider {
+		return Trigger{}, ErrWebhookSignature
+	}
+	if !w.verify(h.HookEngine.Secrets[w.Secret], header, body) {
+		return Trigger{}, ErrWebhookSignature
+	}
+	event := w.event(header)
+	// the ping sent when the webhook is created only triggers a run if
+	// listed
+	if (len(w.Events) > 0 || event == "ping") && !contains(w.Events, event) {
+		return Trigger{}, fmt.Errorf("%w: event %s", ErrWebhookIgnored, event)
+	}
+	payload := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return Trigger{}, fmt.Errorf("Unable to decode webhook payload: %s", err.Error())
+	}
+	if len(w.Branches) > 0 {
+		ref, _ := lookup(payload, "ref").(string)
+		if !strings.HasPrefix(ref, "refs/heads/") || !matchAny(w.Branches, strings.TrimPrefix(ref, "refs/heads/")) {
+			return Trigger{}, fmt.Errorf("%w: ref %s", ErrWebhookIgnored, ref)
+		}
+	}
+	vars := make(map[string]string, len(w.Vars))
+	for name, field := range w.Vars {
+		if value, ok := payloadString(lookup(payload, field)); ok {
+			vars[name] = value
+		}
+	}
+	return Trigger{Vars: vars}, nil
+}
+
+// verify checks the delivery was sent by the provider with secret. An empty
+// secret never verifies.
+func (w *Webhook) verify(secret string, header http.Header, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	switch w.Provider {
+	case "gitlab":
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	case "gitea":
+		if signature := header.Get("X-Gitea-Signature"); signature != "" {
+			return hmac.Equal([]byte("sha256="+signature), []byte(Sign(secret, body)))
+		}
+	}
+	return hmac.Equal([]byte(header.Get("X-Hub-Signature-256")), []byte(Sign(secret, body)))
+}
+
+// event returns the event type of the delivery, e.g. push. GitLab event
+// names like "Tag Push Hook" are turned into tag_push.
+func (w *Webhook) event(header http.Header) string {
+	switch w.Provider {
+	case "gitlab":
+		event := strings.TrimSuffix(header.Get("X-Gitlab-Event"), " Hook")
+		return strings.ReplaceAll(strings.ToLower(event), " ", "_")
+	case "gitea":
+		return header.Get("X-Gitea-Event")
+	}
+	return header.Get("X-GitHub-Event")
+}
+
+// lookup returns the value at a dotted path of the payload, or nil.
+func lookup(payload map[string]interface{}, field string) interface{} {
+	var value interface{} = payload
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// payloadString converts a payload value to a var value the way DecodeVars
+// does. Missing values are reported as not ok.
+func payloadString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const pushPayload = `{
+  "ref": "refs/heads/main",
+  "after": "abc123",
+  "forced": false,
+  "repository": {"full_name": "bjorand/nombda"},
+  "pusher": {"name": "bjorand"}
+}`
+
+func readWebhookHook(t *testing.T, provider string) *Hook {
+	setup()
+	e.Secrets["github_webhook"] = "hook secret"
+	h, err := e.ReadHook("tests/hooks", "tests", "test_webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Webhook.Provider = provider
+	return h
+}
+
+func TestHookWebhookTrigger(t *testing.T) {
+	h := readWebhookHook(t, "github")
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Hub-Signature-256", Sign("hook secret", []byte(pushPayload)))
+	trigger, err := h.WebhookTrigger("github", header, []byte(pushPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := trigger.Vars
+	expected := map[string]string{
+		"git_ref":    "refs/heads/main",
+		"git_sha":    "abc123",
+		"repository": "bjorand/nombda",
+		"pusher":     "bjorand",
+		"forced":     "false",
+	}
+	if !reflect.DeepEqual(output, expected) {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	r, err := h.RunTrigger(trigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Wait(context.Background())
+	outputS := r.State().Registers["deployed"]
+	expectedS := "bjorand/nombda@abc123"
+	if outputS != expectedS {
+		t.Fatalf("want %+v, got %+v", expectedS, outputS)
+	}
+}
+
+func TestHookWebhookProviders(t *testing.T) {
+	tests := []struct {
+		provider string
+		header   map[string]string
+	}{
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "hook secret"}},
+		{"gitea", map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": Sign("hook secret", []byte(pushPayload))[len("sha256="):]}},
+		{"gitea", map[string]string{"X-Gitea-Event": "push", "X-Hub-Signature-256": Sign("hook secret", []byte(pushPayload))}},
+	}
+	for _, test := range tests {
+		h := readWebhookHook(t, test.provider)
+		header := http.Header{}
+		for k, v := range test.header {
+			header.Set(k, v)
+		}
+		trigger, err := h.WebhookTrigger(test.provider, header, []byte(pushPayload))
+		if err != nil {
+			t.Fatalf("%s: %s", test.provider, err)
+		}
+		output := trigger.Vars["git_sha"]
+		expected := "abc123"
+		if output != expected {
+			t.Fatalf("want %+v, got %+v", expected, output)
+		}
+	}
+}
+
+func TestHookWebhookSignature(t *testing.T) {
+	tests := []struct {
+		provider string
+		header   map[string]string
+	}{
+		{"github", map[string]string{"X-GitHub-Event": "push"}},
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": Sign("wrong", []byte(pushPayload))}},
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}},
+	}
+	for _, test := range tests {
+		h := readWebhookHook(t, test.provider)
+		header := http.Header{}
+		for k, v := range test.header {
+			header.Set(k, v)
+		}
+		_, err := h.WebhookTrigger(test.provider, header, []byte(pushPayload))
+		if err != ErrWebhookSignature {
+			t.Fatalf("want %+v, got %+v", ErrWebhookSignature, err)
+		}
+	}
+	// a hook without webhook of the provider never verifies
+	h := readWebhookHook(t, "github")
+	if _, err := h.WebhookTrigger("gitlab", http.Header{}, []byte(pushPayload)); err != ErrWebhookSignature {
+		t.Fatalf("want %+v, got %+v", ErrWebhookSignature, err)
+	}
+	// a hook whose secret is not set never verifies
+	h = readWebhookHook(t, "gitlab")
+	delete(e.Secrets, "github_webhook")
+	header := http.Header{}
+	header.Set("X-Gitlab-Event", "Push Hook")
+	if _, err := h.WebhookTrigger("gitlab", header, []byte(pushPayload)); err != ErrWebhookSignature {
+		t.Fatalf("want %+v, got %+v", ErrWebhookSignature, err)
+	}
+}
+
+func TestHookWebhookFilters(t *testing.T) {
+	tests := []struct {
+		event string
+		body  string
+	}{
+		{"issues", pushPayload},
+		{"push", `{"ref": "refs/heads/feature/foo"}`},
+		{"push", `{"ref": "refs/tags/release/v1"}`},
+	}
+	for _, test := range tests {
+		h := readWebhookHook(t, "github")
+		header := http.Header{}
+		header.Set("X-GitHub-Event", test.event)
+		header.Set("X-Hub-Signature-256", Sign("hook secret", []byte(test.body)))
+		_, err := h.WebhookTrigger("github", header, []byte(test.body))
+		if !errors.Is(err, ErrWebhookIgnored) {
+			t.Fatalf("want %+v, got %+v", ErrWebhookIgnored, err)
+		}
+	}
+	h := readWebhookHook(t, "github")
+	body := `{"ref": "refs/heads/release/v1"}`
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Hub-Signature-256", Sign("hook secret", []byte(body)))
+	if _, err := h.WebhookTrigger("github", header, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHookWebhookPing(t *testing.T) {
+	body := `{"zen": "Keep it logically awesome.", "hook_id": 1}`
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "ping")
+	header.Set("X-Hub-Signature-256", Sign("hook secret", []byte(body)))
+	h := readWebhookHook(t, "github")
+	h.Webhook.Events = nil
+	h.Webhook.Branches = nil
+	if _, err := h.WebhookTrigger("github", header, []byte(body)); !errors.Is(err, ErrWebhookIgnored) {
+		t.Fatalf("want %+v, got %+v", ErrWebhookIgnored, err)
+	}
+	h.Webhook.Events = []string{"ping"}
+	if _, err := h.WebhookTrigger("github", header, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHookWebhookInvalid(t *testing.T) {
+	setup()
+	if _, err := e.ReadHook("tests/hooks", "invalid", "webhook_provider"); err == nil {
+		t.Fatal("want error for invalid webhook provider")
+	}
+}
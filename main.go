@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bjorand/nombda/engine"
 	"github.com/gin-gonic/gin"
@@ -15,11 +24,29 @@ import (
 var (
 	log         = logrus.New()
 	listenAddr  string
+	runsDir     string
+	tokensFile  string
+	auditFile   string
+	auditSize   int64
+	auditKeep   int
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+	tlsRequire  bool
+	otlpURL     string
+	workers     int
+	queueSize   int
+	stateFile   string
+	proxies     string
 	token       = os.Getenv("NOMBDA_TOKEN")
 	configDir   = os.Getenv("CONFIG_DIR")
 	version     string
 	showVersion bool
 	hookEngine  *engine.HookEngine
+	tokens      = &engine.TokenRegistry{}
+	// trustedProxies are the addresses whose X-Forwarded-For header gives
+	// the client IP.
+	trustedProxies []string
 )
 
 type tokenHeader struct {
@@ -33,110 +60,436 @@ func Base() gin.HandlerFunc {
 	}
 }
 
-func AuthRequired() gin.HandlerFunc {
+// Audit records every API call in the audit log, with the token name when
+// the call is authenticated.
+func Audit() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if isTokenAuthenticated(c) {
-			c.Next()
+		c.Next()
+		if hookEngine.Audit == nil {
 			return
 		}
-		// c.JSON(http.StatusUnauthorized, gin.H{"status": "unauthorized"})
-		// c.
+		entry := engine.AuditEntry{
+			Type:       engine.AuditAPICall,
+			SourceIP:   c.ClientIP(),
+			Method:     c.Request.Method,
+			Endpoint:   c.FullPath(),
+			StatusCode: c.Writer.Status(),
+			Hook:       c.Param("id"),
+			Action:     c.Param("action"),
+			RunID:      c.Param("run_id"),
+		}
+		if token, ok := c.Get("token"); ok {
+			entry.Token = token.(*engine.Token).Name
+		}
+		if runID := c.GetString("run_id"); runID != "" {
+			entry.RunID = runID
+		}
+		if err := hookEngine.Audit.Record(entry); err != nil {
+			log.Errorf("Unable to write audit log: %s", err)
+		}
+	}
+}
 
+// AuthRequired rejects requests without a known token, given in the
+// Auth-Token header or as a verified client certificate, and requests whose
+// token does not have scope on the hook of the request, if any. The token is
+// stored in the context as "token".
+func AuthRequired(scope engine.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := tokenHeader{}
+		if err := c.ShouldBindHeader(&t); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		token, ok := tokens.Lookup(t.AuthToken)
+		if !ok && t.AuthToken == "" {
+			token, ok = tokens.LookupClientCert(c.Request.TLS)
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "unauthorized"})
+			return
+		}
+		if !token.HasScope(scope) || (c.Param("id") != "" && !token.MatchHook(c.Param("id"), c.Param("action"))) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "forbidden"})
+			return
+		}
+		c.Set("token", token)
+		c.Next()
 	}
 }
 
-func isTokenAuthenticated(c *gin.Context) bool {
-	t := tokenHeader{}
-	if err := c.ShouldBindHeader(&t); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, err)
-		return false
+// readHook reads the hook of the request, answering 404 if it does not
+// exist.
+func readHook(c *gin.Context) (*engine.Hook, bool) {
+	hook, err := hookEngine.ReadHook(configDir, c.Param("id"), c.Param("action"))
+	if errors.Is(err, engine.ErrHookNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return nil, false
 	}
-	if t.AuthToken != token {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "unauthorized"})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return nil, false
 	}
-	return false
+	return hook, true
 }
 
-func main() {
-	flag.StringVar(&listenAddr, "listen-addr", ":8080", "server listen address")
-	flag.BoolVar(&showVersion, "version", false, "show version")
-	flag.Parse()
+// triggerOptions are query parameters of a trigger which are not run vars.
+var triggerOptions = map[string]bool{
+	"wait":    true,
+	"timeout": true,
+	"log":     true,
+}
 
-	if showVersion {
-		fmt.Printf("nopm-sh version %s", version)
-		os.Exit(0)
+// defaultWaitTimeout is how long a trigger with wait=true waits for the run
+// when no timeout is given.
+const defaultWaitTimeout = 300 * time.Second
+
+// maxWebhookBody is the size over which webhook deliveries are refused.
+// GitHub caps its payloads at 25 MB.
+const maxWebhookBody = 25 << 20
+
+// callbackURLParam is the trigger parameter holding the URL notified when
+// the run finishes. It is not a run var.
+const callbackURLParam = "callback_url"
+
+// errCallbackScope is returned by readTrigger when the token cannot read the
+// run log sent to the callback URL.
+var errCallbackScope = errors.New("callback_url requires the read-logs scope")
+
+// readTrigger reads the trigger from the query parameters and from the JSON
+// object in the request body, which takes precedence.
+func readTrigger(c *gin.Context) (engine.Trigger, error) {
+	vars, err := triggerVars(c)
+	if err != nil {
+		return engine.Trigger{}, err
+	}
+	token := c.MustGet("token").(*engine.Token)
+	callbackURL := vars[callbackURLParam]
+	delete(vars, callbackURLParam)
+	// the callback carries the log excerpt and the outputs of the run
+	if callbackURL != "" && !token.Allows(engine.ScopeReadLogs, c.Param("id"), c.Param("action")) {
+		return engine.Trigger{}, errCallbackScope
 	}
+	return engine.Trigger{
+		Vars:        vars,
+		CallbackURL: callbackURL,
+		Token:       token.Name,
+		SourceIP:    c.ClientIP(),
+		Traceparent: c.GetHeader("traceparent"),
+	}, nil
+}
 
-	token = strings.TrimSpace(token)
-	if token == "" {
-		log.Fatal("Empty NOMBDA_TOKEN environment variable. Failing to start.")
+// triggerVars reads the run vars from the query parameters and from the JSON
+// object in the request body, which takes precedence.
+func triggerVars(c *gin.Context) (map[string]string, error) {
+	vars := make(map[string]string)
+	for k, v := range c.Request.URL.Query() {
+		if !triggerOptions[k] {
+			vars[k] = v[len(v)-1]
+		}
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return vars, nil
+	}
+	bodyVars, err := engine.DecodeVars(body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range bodyVars {
+		vars[k] = v
 	}
+	return vars, nil
+}
 
-	configDir = strings.TrimSpace(configDir)
-	if configDir == "" {
-		log.Fatal("Empty CONFIG_DIR environment variable. Failing to start.")
+// waitOptions parses the wait and timeout query parameters of a trigger. The
+// timeout is either a Go duration like 300s or a number of seconds.
+func waitOptions(c *gin.Context) (bool, time.Duration, error) {
+	wait := false
+	if value := c.Query("wait"); value != "" {
+		var err error
+		if wait, err = strconv.ParseBool(value); err != nil {
+			return false, 0, fmt.Errorf("Invalid wait %s", value)
+		}
+	}
+	value := c.Query("timeout")
+	if value == "" {
+		return wait, defaultWaitTimeout, nil
 	}
+	var timeout time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		timeout = time.Duration(seconds) * time.Second
+	} else if timeout, err = time.ParseDuration(value); err != nil {
+		return false, 0, fmt.Errorf("Invalid timeout %s", value)
+	}
+	if timeout < 0 {
+		return false, 0, fmt.Errorf("Invalid timeout %s", value)
+	}
+	return wait, timeout, nil
+}
 
-	hookEngine := engine.NewHookEngine(configDir)
-	hookEngine.Secrets = engine.ReadSecretFromEnv()
+// waitRun waits for the end of the run before answering with its status. If
+// the timeout expires first, it answers 202 and the run goes on.
+func waitRun(c *gin.Context, run *engine.Run, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	if !run.Wait(ctx) {
+		c.JSON(http.StatusAccepted, gin.H{"id": run.ID, "status": run.State().Status, "queue_position": run.QueuePosition()})
+		return
+	}
+	response := gin.H{"run": runJSON(run)}
+	if c.Query("log") == "true" {
+		response["log"] = run.Log()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// triggerError answers a trigger which did not create a run.
+func triggerError(c *gin.Context, err error) {
+	var paramsErr *engine.ParamsError
+	switch {
+	case errors.As(err, &paramsErr):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error(), "errors": paramsErr.Violations})
+	case errors.Is(err, engine.ErrRunInProgress):
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+	case errors.Is(err, engine.ErrQueueFull):
+		c.Header("Retry-After", "10")
+		c.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+	default:
+		c.String(http.StatusBadRequest, err.Error())
+	}
+}
+
+func runJSON(run *engine.Run) gin.H {
+	state := run.State()
+	return gin.H{
+		"completed":      state.Status.Terminal(),
+		"status":         state.Status,
+		"id":             state.ID,
+		"exit_code":      state.ExitCode,
+		"started_at":     state.StartedAt,
+		"finished_at":    state.FinishedAt,
+		"failed_task":    state.FailedTask,
+		"outputs":        state.Outputs,
+		"trace_id":       state.TraceID,
+		"queue_position": run.QueuePosition(),
+	}
+}
+
+// streamLog sends the run log as Server-Sent Events: one "log" event per
+// line, then an "end" event with the run status once the run is over.
+func streamLog(c *gin.Context, run *engine.Run) {
+	offset := 0
+	c.Stream(func(w io.Writer) bool {
+		events, closed, changed := run.Output.Since(offset)
+		offset += len(events)
+		for _, e := range events {
+			if line := e.Text(); line != "" {
+				c.SSEvent("log", strings.TrimSuffix(line, "\n"))
+			}
+		}
+		if closed {
+			c.SSEvent("end", gin.H{"status": run.State().Status})
+			return false
+		}
+		select {
+		case <-changed:
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// parseProxies reads a comma separated list of IP addresses and CIDR
+// ranges.
+func parseProxies(value string) ([]string, error) {
+	list := []string{}
+	for _, proxy := range strings.Split(value, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("Invalid proxy %s", proxy)
+		}
+		list = append(list, proxy)
+	}
+	return list, nil
+}
 
+// newRouter returns the API handler of hookEngine.
+func newRouter(scheduler *engine.Scheduler) *gin.Engine {
 	router := gin.Default()
+	// gin trusts the X-Forwarded-For header of any address by default,
+	// which would let callers choose the source IP of the audit log
+	router.TrustedProxies = append([]string{}, trustedProxies...)
 	router.Use(gin.Recovery())
 	router.Use(Base())
+	router.Use(Audit())
 
 	authorized := router.Group("/")
 
-	authorized.Use(AuthRequired())
-
 	router.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"version": version})
 	})
 
-	authorized.GET("/hooks", func(c *gin.Context) {
+	router.GET("/metrics", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		c.Status(http.StatusOK)
+		hookEngine.Metrics.WriteTo(c.Writer)
+	})
+
+	authorized.GET("/hooks", AuthRequired(engine.ScopeList), func(c *gin.Context) {
 		hooks, err := hookEngine.Hooks()
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"hooks": hooks})
+		token := c.MustGet("token").(*engine.Token)
+		allowed := []*engine.Hook{}
+		for _, hook := range hooks {
+			if token.MatchHook(hook.Name, hook.Action) {
+				allowed = append(allowed, hook)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"hooks": allowed})
 	})
 
-	authorized.POST("/hooks/:id/:action", func(c *gin.Context) {
-		hook, err := hookEngine.ReadHook(configDir, c.Param("id"), c.Param("action"))
+	authorized.GET("/schedules", AuthRequired(engine.ScopeList), func(c *gin.Context) {
+		entries, err := scheduler.Entries()
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 			return
 		}
-		run, err := hook.Run()
+		token := c.MustGet("token").(*engine.Token)
+		allowed := []engine.ScheduleEntry{}
+		for _, entry := range entries {
+			if token.MatchHook(entry.Hook, entry.Action) {
+				allowed = append(allowed, entry)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"schedules": allowed})
+	})
+
+	authorized.POST("/hooks/:id/:action", AuthRequired(engine.ScopeTrigger), func(c *gin.Context) {
+		hook, ok := readHook(c)
+		if !ok {
+			return
+		}
+		// options are checked before the run starts so that a bad request
+		// never leaves a run behind
+		wait, timeout, err := waitOptions(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		trigger, err := readTrigger(c)
+		if errors.Is(err, errCallbackScope) {
+			c.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+			return
+		}
 		if err != nil {
-			c.String(http.StatusBadRequest, err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		run, err := hook.RunTrigger(trigger)
+		if err != nil {
+			triggerError(c, err)
+			return
+		}
+		c.Set("run_id", run.ID)
+		if wait {
+			waitRun(c, run, timeout)
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"id": run.ID})
 	})
 
-	authorized.GET("/hooks/:id/:action/:run_id", func(c *gin.Context) {
+	// webhooks of git providers are authenticated by the hook webhook
+	// secret, not by the nombda token
+	router.POST("/webhooks/:provider/:id/:action", func(c *gin.Context) {
+		// anyone can post here, so the body is bounded before it is read:
+		// past the limit, the reader fails after returning maxWebhookBody
+		// bytes
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBody))
+		if err != nil && len(body) == maxWebhookBody {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		// unknown hooks are answered like bad signatures so that
+		// unauthenticated callers cannot tell which hooks exist
 		hook, err := hookEngine.ReadHook(configDir, c.Param("id"), c.Param("action"))
 		if err != nil {
+			log.Warnf("Webhook delivery for %s/%s: %s", c.Param("id"), c.Param("action"), err)
+			c.JSON(http.StatusUnauthorized, gin.H{"message": engine.ErrWebhookSignature.Error()})
+			return
+		}
+		trigger, err := hook.WebhookTrigger(c.Param("provider"), c.Request.Header, body)
+		trigger.Token = "webhook:" + c.Param("provider")
+		trigger.SourceIP = c.ClientIP()
+		trigger.Traceparent = c.GetHeader("traceparent")
+		switch {
+		case err == nil:
+		case errors.Is(err, engine.ErrWebhookSignature):
+			c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		case errors.Is(err, engine.ErrWebhookIgnored):
+			c.JSON(http.StatusOK, gin.H{"message": err.Error()})
+			return
+		default:
 			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 			return
 		}
+		run, err := hook.RunTrigger(trigger)
+		if err != nil {
+			triggerError(c, err)
+			return
+		}
+		c.Set("run_id", run.ID)
+		c.JSON(http.StatusOK, gin.H{"id": run.ID})
+	})
+
+	authorized.GET("/hooks/:id/:action/:run_id", AuthRequired(engine.ScopeReadLogs), func(c *gin.Context) {
+		hook, ok := readHook(c)
+		if !ok {
+			return
+		}
 		run, err := hook.GetRun(c.Param("run_id"))
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"message": err})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"run": gin.H{
-			"completed": run.Completed,
-			"id":        run.ID,
-			"exit_code": run.ExitCode,
-		}})
+		c.JSON(http.StatusOK, gin.H{"run": runJSON(run)})
 	})
 
-	authorized.GET("/hooks/:id/:action/:run_id/log", func(c *gin.Context) {
-		hook, err := hookEngine.ReadHook(configDir, c.Param("id"), c.Param("action"))
+	authorized.DELETE("/hooks/:id/:action/:run_id", AuthRequired(engine.ScopeCancel), func(c *gin.Context) {
+		hook, ok := readHook(c)
+		if !ok {
+			return
+		}
+		run, err := hook.GetRun(c.Param("run_id"))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			c.JSON(http.StatusNotFound, gin.H{"message": err})
+			return
+		}
+		if err := run.Cancel(); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"id": run.ID})
+	})
+
+	authorized.GET("/hooks/:id/:action/:run_id/steps", AuthRequired(engine.ScopeReadLogs), func(c *gin.Context) {
+		hook, ok := readHook(c)
+		if !ok {
 			return
 		}
 		run, err := hook.GetRun(c.Param("run_id"))
@@ -144,8 +497,171 @@ func main() {
 			c.JSON(http.StatusNotFound, gin.H{"message": err})
 			return
 		}
-		c.String(http.StatusOK, run.Log())
+		c.JSON(http.StatusOK, gin.H{"steps": run.State().Steps})
+	})
+
+	authorized.GET("/hooks/:id/:action/:run_id/log", AuthRequired(engine.ScopeReadLogs), func(c *gin.Context) {
+		hook, ok := readHook(c)
+		if !ok {
+			return
+		}
+		run, err := hook.GetRun(c.Param("run_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": err})
+			return
+		}
+		switch c.Query("format") {
+		case "", "text":
+			c.String(http.StatusOK, run.Log())
+		case "jsonl":
+			c.Status(http.StatusOK)
+			c.Header("Content-Type", "application/x-ndjson")
+			encoder := json.NewEncoder(c.Writer)
+			for _, e := range run.Output.Events() {
+				encoder.Encode(e)
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"message": "unknown log format " + c.Query("format")})
+		}
+	})
+
+	authorized.GET("/hooks/:id/:action/:run_id/log/stream", AuthRequired(engine.ScopeReadLogs), func(c *gin.Context) {
+		hook, ok := readHook(c)
+		if !ok {
+			return
+		}
+		run, err := hook.GetRun(c.Param("run_id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": err})
+			return
+		}
+		streamLog(c, run)
+	})
+
+	authorized.GET("/audit", AuthRequired(engine.ScopeAdmin), func(c *gin.Context) {
+		if hookEngine.Audit == nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "audit log is disabled"})
+			return
+		}
+		filter := engine.AuditFilter{Hook: c.Query("hook"), Action: c.Query("action")}
+		for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if value := c.Query(param); value != "" {
+				parsed, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid %s %s", param, value)})
+					return
+				}
+				*t = parsed
+			}
+		}
+		entries, err := hookEngine.Audit.Query(filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"entries": entries})
 	})
 
-	router.Run(listenAddr)
+	return router
+}
+
+func main() {
+	flag.StringVar(&listenAddr, "listen-addr", ":8080", "server listen address")
+	flag.StringVar(&tokensFile, "tokens-file", "", "yaml file listing the API tokens and their scopes")
+	flag.StringVar(&auditFile, "audit-file", "", "JSON lines file recording API calls and runs (no audit log if empty)")
+	flag.Int64Var(&auditSize, "audit-max-size", 100, "size in MB over which the audit file is rotated")
+	flag.IntVar(&auditKeep, "audit-max-backups", 5, "number of rotated audit files kept")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, reloaded when it changes (plain HTTP if empty)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file, reloaded when it changes")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA bundle verifying TLS client certificates")
+	flag.BoolVar(&tlsRequire, "tls-require-client-cert", false, "reject TLS clients without a certificate verified by -tls-client-ca")
+	flag.StringVar(&otlpURL, "otlp-traces-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), "OTLP/HTTP URL run traces are sent to, e.g. http://localhost:4318/v1/traces (no tracing if empty)")
+	flag.IntVar(&workers, "workers", 10, "number of runs executed at the same time")
+	flag.IntVar(&queueSize, "queue-size", 100, "number of runs waiting for a worker over which triggers get 429")
+	flag.StringVar(&stateFile, "schedule-state", "", "file recording when schedules were last checked, to find runs missed while nombda was down")
+	flag.StringVar(&proxies, "trusted-proxies", "", "comma separated IP addresses or CIDR ranges of the reverse proxies whose X-Forwarded-For header gives the client IP (the connection address is used if empty)")
+	flag.StringVar(&runsDir, "runs-dir", "", "directory where runs are saved to survive restarts (runs are kept in memory if empty)")
+	flag.BoolVar(&showVersion, "version", false, "show version")
+	flag.Parse()
+
+	if showVersion {
+		fmt.Printf("nopm-sh version %s", version)
+		os.Exit(0)
+	}
+
+	var err error
+	if trustedProxies, err = parseProxies(proxies); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %s", err)
+	}
+
+	if tokensFile != "" {
+		tokens, err = engine.ReadTokenFile(tokensFile)
+		if err != nil {
+			log.Fatalf("Unable to read tokens file: %s", err)
+		}
+	}
+	token = strings.TrimSpace(token)
+	if token != "" {
+		// NOMBDA_TOKEN is kept as an admin token
+		if err := tokens.Add(&engine.Token{Name: "default", Token: token, Scopes: []engine.Scope{engine.ScopeAdmin}}); err != nil {
+			log.Fatalf("Invalid NOMBDA_TOKEN: %s", err)
+		}
+	}
+	if len(tokens.Tokens) == 0 {
+		log.Fatal("Empty NOMBDA_TOKEN environment variable and no -tokens-file. Failing to start.")
+	}
+
+	configDir = strings.TrimSpace(configDir)
+	if configDir == "" {
+		log.Fatal("Empty CONFIG_DIR environment variable. Failing to start.")
+	}
+
+	var store engine.RunStore
+	if runsDir != "" {
+		fileStore, err := engine.NewFileRunStore(runsDir)
+		if err != nil {
+			log.Fatalf("Unable to open runs directory: %s", err)
+		}
+		store = fileStore
+	}
+
+	hookEngine = engine.NewHookEngine(configDir, store)
+	hookEngine.Secrets = engine.ReadSecretFromEnv()
+	hookEngine.CallbackSecret = os.Getenv("NOMBDA_CALLBACK_SECRET")
+	if workers < 1 || queueSize < 0 {
+		log.Fatal("-workers must be at least 1 and -queue-size at least 0. Failing to start.")
+	}
+	hookEngine.Queue = engine.NewRunQueue(workers, queueSize)
+	if otlpURL != "" {
+		hookEngine.SpanExporter = &engine.OTLPExporter{Endpoint: otlpURL}
+	}
+	if auditFile != "" {
+		audit, err := engine.NewAuditLog(auditFile, auditSize*1024*1024, auditKeep)
+		if err != nil {
+			log.Fatalf("Unable to open audit file: %s", err)
+		}
+		hookEngine.Audit = audit
+	}
+
+	scheduler, err := engine.NewScheduler(hookEngine, stateFile)
+	if err != nil {
+		log.Fatalf("Unable to read schedule state: %s", err)
+	}
+	go scheduler.Run(context.Background())
+
+	router := newRouter(scheduler)
+
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: router,
+	}
+	if tlsCert == "" {
+		log.Fatal(server.ListenAndServe())
+	}
+	tlsConfig, err := engine.TLSConfig(tlsCert, tlsKey, tlsClientCA, tlsRequire)
+	if err != nil {
+		log.Fatalf("Unable to configure TLS: %s", err)
+	}
+	server.TLSConfig = tlsConfig
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
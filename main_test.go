@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bjorand/nombda/engine"
+	"github.com/gin-gonic/gin"
+)
+
+func setupRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	configDir = "engine/tests/hooks"
+	trustedProxies = nil
+	hookEngine = engine.NewHookEngine(configDir, nil)
+	tokens = &engine.TokenRegistry{}
+	for _, token := range []*engine.Token{
+		{Name: "admin", Token: "admin", Scopes: []engine.Scope{engine.ScopeAdmin}},
+		{Name: "ci", Token: "ci", Scopes: []engine.Scope{engine.ScopeTrigger, engine.ScopeReadLogs, engine.ScopeCancel}, Hooks: []string{"tests/test_handler"}},
+		{Name: "ops", Token: "ops", Scopes: []engine.Scope{engine.ScopeList}},
+		{Name: "cert", ClientSubject: "CN=ci,O=nombda", Scopes: []engine.Scope{engine.ScopeReadLogs}, Hooks: []string{"tests/test_handler"}},
+	} {
+		if err := tokens.Add(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scheduler, err := engine.NewScheduler(hookEngine, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRouter(scheduler)
+}
+
+// finishedRun returns a finished run of the test hook action.
+func finishedRun(t *testing.T, action string) *engine.Run {
+	hook, err := hookEngine.ReadHook(configDir, "tests", action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := hook.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Wait(context.Background())
+	return run
+}
+
+func TestAuthRequired(t *testing.T) {
+	router := setupRouter(t)
+	run := finishedRun(t, "test_handler")
+	other := finishedRun(t, "test_register")
+	clientCert := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "ci", Organization: []string{"nombda"}}},
+	}}}
+	tests := []struct {
+		method   string
+		path     string
+		token    string
+		tls      *tls.ConnectionState
+		expected int
+	}{
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "", nil, http.StatusUnauthorized},
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "unknown", nil, http.StatusUnauthorized},
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "ci", nil, http.StatusOK},
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "admin", nil, http.StatusOK},
+		// missing scope
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "ops", nil, http.StatusForbidden},
+		{"GET", "/hooks", "ci", nil, http.StatusForbidden},
+		// hook not matching the token patterns
+		{"GET", "/hooks/tests/test_register/" + other.ID, "ci", nil, http.StatusForbidden},
+		{"DELETE", "/hooks/tests/test_register/" + other.ID, "ci", nil, http.StatusForbidden},
+		// run of another hook through a matching hook
+		{"GET", "/hooks/tests/test_handler/" + other.ID, "ci", nil, http.StatusNotFound},
+		{"GET", "/hooks/tests/test_handler/" + other.ID + "/steps", "ci", nil, http.StatusNotFound},
+		{"GET", "/hooks/tests/test_handler/" + other.ID + "/log", "ci", nil, http.StatusNotFound},
+		{"GET", "/hooks/tests/test_handler/" + other.ID + "/log/stream", "ci", nil, http.StatusNotFound},
+		{"DELETE", "/hooks/tests/test_handler/" + other.ID, "ci", nil, http.StatusNotFound},
+		// client certificate without token
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "", clientCert, http.StatusOK},
+		{"GET", "/hooks/tests/test_register/" + other.ID, "", clientCert, http.StatusForbidden},
+		{"DELETE", "/hooks/tests/test_handler/" + run.ID, "", clientCert, http.StatusForbidden},
+		// an unknown token is not replaced by the client certificate
+		{"GET", "/hooks/tests/test_handler/" + run.ID, "unknown", clientCert, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Auth-Token", test.token)
+		}
+		req.TLS = test.tls
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		output := w.Code
+		if output != test.expected {
+			t.Fatalf("%s %s with token %q: want %+v, got %+v", test.method, test.path, test.token, test.expected, output)
+		}
+	}
+}
+
+func TestTriggerCallbackScope(t *testing.T) {
+	router := setupRouter(t)
+	if err := tokens.Add(&engine.Token{Name: "trigger", Token: "trigger", Scopes: []engine.Scope{engine.ScopeTrigger}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token    string
+		expected int
+	}{
+		{"trigger", http.StatusForbidden},
+		{"ci", http.StatusOK},
+	}
+	for _, test := range tests {
+		body := strings.NewReader(`{"callback_url": "http://127.0.0.1:1/callback"}`)
+		req := httptest.NewRequest("POST", "/hooks/tests/test_handler", body)
+		req.Header.Set("Auth-Token", test.token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		output := w.Code
+		if output != test.expected {
+			t.Fatalf("token %s: want %+v, got %+v", test.token, test.expected, output)
+		}
+	}
+}
+
+func TestTriggerInvalidWaitOptions(t *testing.T) {
+	router := setupRouter(t)
+	for _, query := range []string{"wait=true&timeout=5m30", "wait=yes", "wait=true&timeout=-1"} {
+		req := httptest.NewRequest("POST", "/hooks/tests/test_handler?"+query, nil)
+		req.Header.Set("Auth-Token", "ci")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		output := w.Code
+		expected := http.StatusBadRequest
+		if output != expected {
+			t.Fatalf("%s: want %+v, got %+v", query, expected, output)
+		}
+	}
+	// no run was started
+	var metrics strings.Builder
+	hookEngine.Metrics.WriteTo(&metrics)
+	if strings.Contains(metrics.String(), `action="test_handler"`) {
+		t.Fatalf("want no run, got metrics %s", metrics.String())
+	}
+}
+
+func TestTriggerWait(t *testing.T) {
+	router := setupRouter(t)
+	hookEngine.Secrets["foo"] = "s3cr3t"
+	req := httptest.NewRequest("POST", "/hooks/tests/test_outputs?wait=true&log=true", nil)
+	req.Header.Set("Auth-Token", "admin")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	outputCode := w.Code
+	expectedCode := http.StatusOK
+	if outputCode != expectedCode {
+		t.Fatalf("want %+v, got %+v", expectedCode, outputCode)
+	}
+	var response struct {
+		Run struct {
+			Completed bool              `json:"completed"`
+			Status    engine.RunStatus  `json:"status"`
+			ExitCode  int               `json:"exit_code"`
+			Outputs   map[string]string `json:"outputs"`
+		} `json:"run"`
+		Log string `json:"log"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.Run.Completed || response.Run.Status != engine.RunSucceeded || response.Run.ExitCode != 0 {
+		t.Fatalf("want succeeded run, got %+v", response.Run)
+	}
+	output := response.Run.Outputs["git_sha"]
+	expected := "abc123"
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	if !strings.Contains(response.Log, "[STDOUT] abc123") {
+		t.Fatalf("want run log, got %+v", response.Log)
+	}
+}
+
+func TestTriggerWaitTimeout(t *testing.T) {
+	router := setupRouter(t)
+	req := httptest.NewRequest("POST", "/hooks/tests/test_live_output?wait=true&timeout=100ms", nil)
+	req.Header.Set("Auth-Token", "admin")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	outputCode := w.Code
+	expectedCode := http.StatusAccepted
+	if outputCode != expectedCode {
+		t.Fatalf("want %+v, got %+v", expectedCode, outputCode)
+	}
+	var response struct {
+		ID     string           `json:"id"`
+		Status engine.RunStatus `json:"status"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status.Terminal() {
+		t.Fatalf("want run in progress, got %+v", response.Status)
+	}
+	// the run goes on after the response
+	hook, err := hookEngine.ReadHook(configDir, "tests", "test_live_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := hook.GetRun(response.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Wait(context.Background())
+	output := run.State().Status
+	expected := engine.RunSucceeded
+	if output != expected {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+}
+
+func TestTriggerError(t *testing.T) {
+	router := setupRouter(t)
+	hookEngine.Queue = engine.NewRunQueue(1, 0)
+	// the only worker is busy
+	hook, err := hookEngine.ReadHook(configDir, "tests", "test_cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := hook.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Wait(context.Background())
+	defer busy.Cancel()
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		// image_tag is required
+		{"/hooks/tests/test_params", http.StatusUnprocessableEntity},
+		{"/hooks/tests/test_handler", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.path, nil)
+		req.Header.Set("Auth-Token", "admin")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		output := w.Code
+		if output != test.expected {
+			t.Fatalf("%s: want %+v, got %+v", test.path, test.expected, output)
+		}
+	}
+}
+
+func TestWebhookUnknownHook(t *testing.T) {
+	router := setupRouter(t)
+	hookEngine.Secrets["github_webhook"] = "hook secret"
+	var bodies []string
+	for _, path := range []string{"/webhooks/github/tests/missing", "/webhooks/github/tests/test_handler", "/webhooks/github/tests/test_webhook", "/webhooks/github/invalid/webhook_provider"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"ref": "refs/heads/main"}`))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", engine.Sign("wrong", []byte(`{"ref": "refs/heads/main"}`)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		output := w.Code
+		expected := http.StatusUnauthorized
+		if output != expected {
+			t.Fatalf("%s: want %+v, got %+v", path, expected, output)
+		}
+		bodies = append(bodies, w.Body.String())
+	}
+	for _, body := range bodies[1:] {
+		if body != bodies[0] {
+			t.Fatalf("want %+v, got %+v", bodies[0], body)
+		}
+	}
+}
+
+func TestWebhookBodyTooLarge(t *testing.T) {
+	router := setupRouter(t)
+	body := strings.Repeat("a", maxWebhookBody+1)
+	for _, length := range []int64{int64(len(body)), -1} {
+		req := httptest.NewRequest("POST", "/webhooks/github/tests/test_webhook", strings.NewReader(body))
+		// -1 is a body of unknown length, like a chunked request
+		req.ContentLength = length
+		req.Header.Set("X-GitHub-Event", "push")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		output := w.Code
+		expected := http.StatusRequestEntityTooLarge
+		if output != expected {
+			t.Fatalf("content length %d: want %+v, got %+v", length, expected, output)
+		}
+	}
+}
+
+func TestAuditSourceIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nombda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		proxies  []string
+		expected string
+	}{
+		// the header of an untrusted address is ignored
+		{nil, "192.0.2.1"},
+		{[]string{"192.0.2.0/24"}, "6.6.6.6"},
+	}
+	for _, test := range tests {
+		setupRouter(t)
+		trustedProxies = test.proxies
+		router := newRouter(nil)
+		audit, err := engine.NewAuditLog(dir+"/audit.jsonl", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hookEngine.Audit = audit
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "6.6.6.6")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		entries, err := audit.Query(engine.AuditFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := entries[len(entries)-1].SourceIP
+		if output != test.expected {
+			t.Fatalf("proxies %v: want %+v, got %+v", test.proxies, test.expected, output)
+		}
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	output, err := parseProxies(" 10.0.0.1, 192.168.0.0/16,,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.1", "192.168.0.0/16", "::1"}
+	if strings.Join(output, " ") != strings.Join(expected, " ") {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	if _, err := parseProxies("10.0.0.1,proxy.local"); err == nil {
+		t.Fatal("want error for invalid proxy")
+	}
+}
+
+func TestStreamLog(t *testing.T) {
+	router := setupRouter(t)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	hook, err := hookEngine.ReadHook(configDir, "tests", "test_live_output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run, err := hook.Run(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", server.URL+"/hooks/tests/test_live_output/"+run.ID+"/log/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Auth-Token", "admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// the stream ends with the run
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events [][2]string
+	for _, block := range strings.Split(strings.TrimSpace(string(data)), "\n\n") {
+		lines := strings.SplitN(block, "\n", 2)
+		events = append(events, [2]string{strings.TrimPrefix(lines[0], "event:"), strings.TrimPrefix(lines[1], "data:")})
+	}
+	var output []string
+	for _, event := range events[:len(events)-1] {
+		// step events have no message and are not sent
+		if event[0] != "log" || event[1] == "" {
+			t.Fatalf("want log line, got %+v", event)
+		}
+		if i := strings.Index(event[1], "[STDOUT] "); i >= 0 {
+			output = append(output, event[1][i+len("[STDOUT] "):])
+		}
+	}
+	expected := []string{"first", "second"}
+	if strings.Join(output, " ") != strings.Join(expected, " ") {
+		t.Fatalf("want %+v, got %+v", expected, output)
+	}
+	outputEnd := events[len(events)-1]
+	expectedEnd := [2]string{"end", `{"status":"succeeded"}`}
+	if outputEnd != expectedEnd {
+		t.Fatalf("want %+v, got %+v", expectedEnd, outputEnd)
+	}
+}